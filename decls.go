@@ -4,26 +4,34 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
+	"text/scanner"
 )
 
 type Decls struct {
 	names  map[string]Type
 	exprs  map[int64]Type
 	code   map[int64]string
+	pos    map[int64]scanner.Position /* of the expressions */
+	uses   map[int]scanner.Position   /* first uses of the identifiers */
 	strict bool
 	idents []string
-	errors []string
+	scope  []int /* addresses of the let bindings in scope */
+	errors []*ParseError
 	fields []struct {
 		eid  int64
 		name string
 		pos  *int
 	}
-	sameTypes [][]int64
-	values    []Value
-	regexps   []*regexp.Regexp
-	funcs     []*Func
+	calls   []call
+	layouts map[int64]*int /* conversions of the values of expressions */
+	values  []Value
+	regexps []*regexp.Regexp
+	funcs   []*Func
 }
 
 func NewDecls() *Decls {
@@ -31,9 +39,55 @@ func NewDecls() *Decls {
 	res.names = make(map[string]Type)
 	res.exprs = make(map[int64]Type)
 	res.code = make(map[int64]string)
+	res.pos = make(map[int64]scanner.Position)
+	res.uses = make(map[int]scanner.Position)
+	res.layouts = make(map[int64]*int)
 	return res
 }
 
+// call is a use of the function (fn) with the arguments (eids) which types
+// are checked by Verify.
+type call struct {
+	fn   int
+	eids []int64
+}
+
+// typeError is an error in the type of the expression (eid).
+type typeError struct {
+	eid int64
+	msg string
+}
+
+// errReported marks the types which cannot be resolved because of an error
+// reported elsewhere (e.g. an unknown identifier).
+var errReported = errors.New("already reported")
+
+func (e *typeError) Error() string {
+	return e.msg
+}
+
+// byPosition orders errors by their positions (and messages).
+type byPosition []*ParseError
+
+func (b byPosition) Len() int {
+	return len(b)
+}
+
+func (b byPosition) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byPosition) Less(i, j int) bool {
+	if b[i].Line != b[j].Line {
+		return b[i].Line < b[j].Line
+	}
+	if b[i].Column != b[j].Column {
+		return b[i].Column < b[j].Column
+	}
+
+	return b[i].Message < b[j].Message
+}
+
 func (d *Decls) Strict(on bool) {
 	d.strict = on
 }
@@ -55,6 +109,45 @@ func (d *Decls) Declare(name string, v Value, t Type) (int, error) {
 	return addr, nil
 }
 
+// Bind declares the name of a let binding in a new slot (hiding the earlier
+// uses of an unknown identifier with the same name) until the matching Pop.
+func (d *Decls) Bind(name string, t Type) (int, error) {
+	if d.names[name] != nil {
+		d.scope = append(d.scope, -1)
+		return -1, fmt.Errorf("'%v' is already declared", name)
+	}
+
+	addr := len(d.idents)
+	d.idents = append(d.idents, name)
+	d.values = append(d.values, nil)
+	d.names[name] = t
+	d.scope = append(d.scope, addr)
+
+	return addr, nil
+}
+
+// Pop ends the scope of the innermost let binding: the later uses of its
+// name are unknown identifiers (or other declarations).
+func (d *Decls) Pop() {
+	addr := d.scope[len(d.scope)-1]
+	d.scope = d.scope[:len(d.scope)-1]
+	if addr < 0 {
+		return /* failed to declare */
+	}
+
+	name := d.idents[addr]
+	hidden := fmt.Sprintf("__let_%d", addr)
+	d.idents[addr] = hidden
+	d.names[hidden] = d.names[name]
+	delete(d.names, name)
+
+	for eid, t := range d.exprs {
+		if ti, ok := t.(TypeOfIdent); ok && string(ti) == name {
+			d.exprs[eid] = TypeOfIdent(hidden)
+		}
+	}
+}
+
 func (d *Decls) AddFunc(fn *Func) {
 	d.funcs = append(d.funcs, fn)
 	d.names[fn.Name] = fn.Type
@@ -72,15 +165,20 @@ func (d *Decls) RegExp(pattern string) (int, error) {
 	return pos, nil
 }
 
-func (d *Decls) UseIdent(name string) int {
+func (d *Decls) UseIdent(name string, pos scanner.Position) int {
 	if d.strict && d.names[name] == nil {
-		d.err("unknown identifier '%v'", name)
+		d.err(pos, "unknown identifier '%v'%v", name, suggest(name, d.known(false)))
 	}
 
-	return d.insert(name)
+	addr := d.insert(name)
+	if _, ok := d.uses[addr]; !ok {
+		d.uses[addr] = pos
+	}
+
+	return addr
 }
 
-func (d *Decls) UseFunc(name string, eids []int64) int {
+func (d *Decls) UseFunc(name string, eids []int64, pos scanner.Position) int {
 	fn := -1
 	for i, _ := range d.funcs {
 		if d.funcs[i].Name == name {
@@ -90,13 +188,13 @@ func (d *Decls) UseFunc(name string, eids []int64) int {
 	}
 
 	if fn < 0 {
-		d.err("unknown function %s", name)
+		d.err(pos, "unknown function %s%v", name, suggest(name, d.known(true)))
 	} else if len(d.funcs[fn].Type.Args) != len(eids) {
-		d.err("function %v takes %v arguments", name, len(d.funcs[fn].Type.Args))
+		d.err(pos, "function %v takes %v arguments", name, len(d.funcs[fn].Type.Args))
+	} else {
+		d.calls = append(d.calls, call{fn, eids})
 	}
 
-	// TODO: check the argument types
-
 	return fn
 }
 
@@ -127,22 +225,34 @@ func (d *Decls) UseField(eid int64, name string) *int {
 	return d.fields[pos].pos
 }
 
-func (d *Decls) SameType(eids []int64) {
-	d.sameTypes = append(d.sameTypes, eids)
+// UseLayout returns the function (set by Verify, -1 if not needed) that lays
+// out the values of the expression as the ones of the list or the coalesce
+// (if) expression it is a part of.
+func (d *Decls) UseLayout(eid int64) *int {
+	fn := new(int)
+	*fn = -1
+	d.layouts[eid] = fn
+
+	return fn
 }
 
-func (d *Decls) SetType(e Expr, t Type) {
+// SetType sets the type of the expression found at pos in the source.
+func (d *Decls) SetType(e Expr, t Type, pos scanner.Position) {
 	d.exprs[e.Id] = t
 	d.code[e.Id] = e.Name
+	d.pos[e.Id] = pos
 }
 
-func (d *Decls) Verify(resEID int64) (Type, []string) {
+// Verify resolves the types of all expressions and returns the type of the
+// resulting one (resEID) together with the errors ordered by their positions
+// (one per position).
+func (d *Decls) Verify(resEID int64) (Type, []*ParseError) {
 	var resType Type = nil
 
 	// check identifiers
-	for _, n := range d.idents {
+	for i, n := range d.idents {
 		if d.names[n] == nil {
-			d.err("unknown identifier '%v'", n)
+			d.err(d.uses[i], "unknown identifier '%v'%v", n, suggest(n, d.known(false)))
 		}
 	}
 
@@ -150,7 +260,7 @@ func (d *Decls) Verify(resEID int64) (Type, []string) {
 	for _, t := range d.names {
 		_, err := d.resolve(t)
 		if err != nil {
-			d.err("%v", err)
+			d.fail(-1, err)
 		}
 	}
 
@@ -158,7 +268,7 @@ func (d *Decls) Verify(resEID int64) (Type, []string) {
 	for eid, t := range d.exprs {
 		rt, err := d.resolve(t)
 		if err != nil {
-			d.err("%v", err)
+			d.fail(eid, err)
 		} else if eid == resEID {
 			resType = rt
 		}
@@ -169,33 +279,144 @@ func (d *Decls) Verify(resEID int64) (Type, []string) {
 		if *f.pos < 0 {
 			t, err := d.resolve(d.exprs[f.eid])
 			if err != nil {
-				d.err("%v", err)
+				d.fail(f.eid, err)
 			} else {
-				ot, _ := t.(ObjectType)
+				ot, _ := narrow(t, "object").(ObjectType)
 				*f.pos = ot.Pos(f.name)
 			}
 		}
 	}
 
-	// TODO: check sameTypes + web_test
+	// convert the values laid out unlike the type they are a part of
+	for _, t := range d.exprs {
+		var eids []int64
+		var want Type
+		switch tt := t.(type) {
+		case TypeOfCommon:
+			eids = tt
+			want, _ = d.resolve(tt)
+		case ListType:
+			if tu, isUnion := tt.Elem.(TypeOfUnion); isUnion {
+				eids = tu
+				want, _ = d.resolve(tu)
+			}
+		}
+
+		for _, eid := range eids {
+			from, err := d.resolve(d.exprs[eid])
+			if want == nil || err != nil || d.layouts[eid] == nil || sameLayout(from, want) {
+				continue
+			}
+
+			*d.layouts[eid] = len(d.funcs)
+			d.funcs = append(d.funcs, FuncLayout(from, want))
+		}
+	}
+
+	// check argument types of function calls
+	for _, c := range d.calls {
+		fn := d.funcs[c.fn]
+		for i, eid := range c.eids {
+			t, err := d.resolve(d.exprs[eid])
+			if err != nil {
+				continue /* already reported */
+			}
+
+			want := fn.Type.Args[i]
+			if !fits(t, want) {
+				exp := describe(want)
+				if l, isList := want.(ListType); isList && l.Elem == nil {
+					exp = "a list"
+				}
+
+				d.err(d.pos[eid], "argument %d of %v must be %v, '%v' is %v", i+1, fn.Name, exp, d.code[eid], describe(t))
+			}
+		}
+	}
+
+	sort.Sort(byPosition(d.errors))
+	res := make([]*ParseError, 0, len(d.errors))
+	for i, e := range d.errors {
+		if i == 0 || e.Line != d.errors[i-1].Line || e.Column != d.errors[i-1].Column {
+			res = append(res, e)
+		}
+	}
+
+	return resType, res
+}
+
+func (d *Decls) err(pos scanner.Position, msg string, args ...interface{}) {
+	d.errors = append(d.errors, NewError(pos.Line, pos.Column, msg, args...))
+}
+
+// fail reports a type error at the position of the expression causing it
+// (or at the position of eid for the other errors).
+func (d *Decls) fail(eid int64, err error) {
+	if err == errReported {
+		return
+	}
+
+	if te, ok := err.(*typeError); ok {
+		eid = te.eid
+	}
+
+	d.err(d.pos[eid], "%v", err)
+}
+
+// known returns the names of the declared functions (or of the other
+// identifiers).
+func (d *Decls) known(funcs bool) []string {
+	res := make([]string, 0)
+	for n, t := range d.names {
+		if t == nil || strings.HasPrefix(n, "__") {
+			continue
+		}
+
+		if _, isFunc := t.(FuncType); isFunc == funcs {
+			res = append(res, n)
+		}
+	}
 
-	return resType, d.errors
+	return res
 }
 
-func (d *Decls) err(msg string, args ...interface{}) {
-	d.errors = append(d.errors, fmt.Sprintf(msg, args...))
+// suggest returns a " (did you mean ...?)" hint listing the candidates most
+// similar to the name (if any are similar enough).
+func suggest(name string, candidates []string) string {
+	best := 0.5
+	var res []string
+	for _, c := range candidates {
+		f := Fuzzy(name, c)
+		if f > best {
+			best = f
+			res = nil
+		}
+		if f == best {
+			res = append(res, c)
+		}
+	}
+
+	if len(res) == 0 {
+		return ""
+	}
+
+	sort.Strings(res)
+	if len(res) > 3 {
+		res = res[:3]
+	}
+
+	return fmt.Sprintf(" (did you mean '%v'?)", strings.Join(res, "' or '"))
 }
 
+// find returns the address of the latest declaration of the name.
 func (d *Decls) find(name string) int {
-	addr := -1
-	for i, n := range d.idents {
-		if n == name {
-			addr = i
-			break
+	for i := len(d.idents) - 1; i >= 0; i-- {
+		if d.idents[i] == name {
+			return i
 		}
 	}
 
-	return addr
+	return -1
 }
 
 func (d *Decls) insert(name string) int {
@@ -219,13 +440,13 @@ func (d *Decls) resolve(t Type) (Type, error) {
 			return nil, err
 		}
 
-		o, isObject := ot.(ObjectType)
+		o, isObject := narrow(ot, "object").(ObjectType)
 		if !isObject {
-			return nil, fmt.Errorf("'%v' is not an object", d.code[st.eid])
+			return nil, &typeError{st.eid, fmt.Sprintf("'%v' is not an object", d.code[st.eid])}
 		}
 
 		if !o.Has(st.name) {
-			return nil, fmt.Errorf("object '%v' does not have field '%v'", d.code[st.eid], st.name)
+			return nil, &typeError{st.eid, fmt.Sprintf("object '%v' does not have field '%v'%v", d.code[st.eid], st.name, suggest(st.name, o.Fields()))}
 		}
 
 		return o.Type(st.name), nil
@@ -236,19 +457,71 @@ func (d *Decls) resolve(t Type) (Type, error) {
 			return nil, err
 		}
 
-		l, isList := lt.(ListType)
+		l, isList := narrow(lt, "list").(ListType)
 		if !isList {
-			return nil, fmt.Errorf("'%v' is not a list", d.code[eid])
+			return nil, &typeError{eid, fmt.Sprintf("'%v' is not a list", d.code[eid])}
 		}
 
 		return l.Elem, nil
 	case TypeOfIdent:
+		if d.names[string(st)] == nil {
+			return nil, errReported /* unknown identifier */
+		}
+
 		return d.resolve(d.names[string(st)])
+	case TypeOfCommon:
+		var res Type
+		for i, eid := range st {
+			t, err := d.resolve(d.exprs[eid])
+			if err != nil {
+				return nil, err
+			}
+
+			if i == 0 {
+				res = t
+			} else if res = unify(res, t); res == nil {
+				return nil, &typeError{eid, fmt.Sprintf("'%v' and '%v' have different types", d.code[st[0]], d.code[eid])}
+			}
+		}
+
+		return res, nil
+	case TypeOfUnion:
+		var res Type
+		for i, eid := range st {
+			t, err := d.resolve(d.exprs[eid])
+			if err != nil {
+				return nil, err
+			}
+
+			if i == 0 {
+				res = t
+			} else if res = union(res, t); res == nil {
+				return nil, &typeError{eid, fmt.Sprintf("'%v' and '%v' cannot be elements of the same list", d.code[st[0]], d.code[eid])}
+			}
+		}
+
+		return res, nil
 	case TypeOfFunc:
-		return d.resolve(d.names[string(st)])
+		ft, err := d.resolve(d.names[string(st)])
+		if err != nil {
+			return nil, err
+		}
+
+		f, isFunc := ft.(FuncType)
+		if !isFunc {
+			return nil, fmt.Errorf("'%v' is not a function", string(st))
+		}
+
+		return f.Return, nil
 	case ScalarType:
 		return ScalarType(st), nil
+	case NullType:
+		return NullType(st), nil
 	case ListType:
+		if st.Elem == nil {
+			return st, nil
+		}
+
 		t, err := d.resolve(st.Elem)
 		if err != nil {
 			return nil, err
@@ -272,6 +545,18 @@ func (d *Decls) resolve(t Type) (Type, error) {
 		}
 
 		return FuncType{ret, args}, nil
+	case UnionType:
+		ut := make(UnionType, len(st))
+		for i, a := range st {
+			t, err := d.resolve(a)
+			if err != nil {
+				return nil, err
+			}
+
+			ut[i] = t
+		}
+
+		return ut, nil
 	case ObjectType:
 		attrs := make(map[string]bool)
 		ot := make(ObjectType, len(st))
@@ -4,9 +4,9 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 )
 
@@ -14,9 +14,10 @@ type Expr struct {
 	Id   int64
 	Name string
 	Code func() []Op
+	Args []Expr /* operands of a binary expression */
 }
 
-var BadExpr = Expr{0, "", nil}
+var BadExpr = Expr{0, "", nil, nil}
 var exprSeqNum int64 = 1
 
 func nextEID() int64 {
@@ -26,103 +27,236 @@ func nextEID() int64 {
 func ExprLoad(name string, addr int) Expr {
 	return Expr{nextEID(), name, func() []Op {
 		return []Op{OpLoad(addr)}
-	}}
+	}, nil}
 }
 
-func ExprObject(fields []Expr) Expr {
-	name := new(bytes.Buffer)
-	fmt.Fprintf(name, "{")
-	for i, f := range fields {
-		if i != 0 {
-			fmt.Fprintf(name, ", ")
-		}
-		fmt.Fprintf(name, f.Name)
+// names joins the names of the expressions with commas.
+func names(exprs []Expr) string {
+	list := make([]string, len(exprs))
+	for i, e := range exprs {
+		list[i] = e.Name
 	}
-	fmt.Fprintf(name, "}")
 
-	return Expr{nextEID(), name.String(), func() []Op {
+	return strings.Join(list, ", ")
+}
+
+func ExprObject(fields []Expr) Expr {
+	return Expr{nextEID(), fmt.Sprintf("{%v}", names(fields)), func() []Op {
 		code := []Op{OpObject(len(fields))}
 		for i, f := range fields {
-			for _, c := range f.Code() {
-				code = append(code, c)
-			}
+			code = append(code, f.Code()...)
 			code = append(code, OpSet(i))
 		}
 
 		return code
-	}}
+	}, nil}
 }
 
 func ExprList(elems []Expr) Expr {
-	// TODO: compose a name
-	return Expr{nextEID(), "", func() []Op {
+	return Expr{nextEID(), fmt.Sprintf("[%v]", names(elems)), func() []Op {
 		code := []Op{OpList()}
 		for _, e := range elems {
-			for _, c := range e.Code() {
-				code = append(code, c)
-			}
+			code = append(code, e.Code()...)
 			code = append(code, OpAppend())
 		}
 
 		return code
-	}}
+	}, nil}
 }
 
 func ExprComp(loop *Loop, resAddr int) Expr {
 	// TODO: compose a name
 	return Expr{nextEID(), "", func() []Op {
-		return append(loop.Code(), OpLoad(resAddr))
-	}}
+		code := []Op{OpList(), OpStore(resAddr)} /* reset the result */
+		code = append(code, loop.Code()...)
+		code = append(code, OpLoad(resAddr))
+
+		if loop.order != nil {
+			code = append(code, loop.order.Code()...)
+		}
+
+		return code
+	}, nil}
+}
+
+func ExprGroup(loop *Loop, gid int) Expr {
+	return Expr{nextEID(), "", func() []Op {
+		code := []Op{OpBuckets(gid)}
+		code = append(code, loop.Code()...)
+
+		return append(code, OpGroups(gid))
+	}, nil}
+}
+
+// ExprProbe looks up the elements of hash buckets (gid) matching the value
+// of the expression.
+func ExprProbe(e Expr, gid int) Expr {
+	return Expr{nextEID(), e.Name, func() []Op {
+		return append(e.Code(), OpProbe(gid))
+	}, nil}
+}
+
+// ExprBind stores the value of e at addr.
+func ExprBind(name string, e Expr, addr int) Expr {
+	return Expr{nextEID(), fmt.Sprintf("%v = %v", name, e.Name), func() []Op {
+		return append(e.Code(), OpStore(addr))
+	}, nil}
+}
+
+// ExprLet evaluates the binding before the expression e.
+func ExprLet(bind Expr, e Expr) Expr {
+	return Expr{nextEID(), fmt.Sprintf("let %v in %v", bind.Name, e.Name), func() []Op {
+		return append(bind.Code(), e.Code()...)
+	}, nil}
+}
+
+// ExprCond evaluates either t or e depending on the value of the condition.
+func ExprCond(cond, t, e Expr) Expr {
+	name := fmt.Sprintf("if %v then %v else %v", cond.Name, t.Name, e.Name)
+	return Expr{nextEID(), name, func() []Op {
+		tc := t.Code()
+		ec := e.Code()
+
+		code := cond.Code()
+		code = append(code, OpTest(len(tc)+2))
+		code = append(code, tc...)
+		code = append(code, OpJump(len(ec)+1))
+
+		return append(code, ec...)
+	}, nil}
+}
+
+// ExprLayout converts the values of e using the function fn (if any, see
+// Decls.UseLayout).
+func ExprLayout(e Expr, fn *int) Expr {
+	return Expr{e.Id, e.Name, func() []Op {
+		if *fn < 0 {
+			return e.Code()
+		}
+
+		return append(e.Code(), OpCall(*fn))
+	}, e.Args}
+}
+
+// ExprCoalesce evaluates to the first of its arguments which is not null.
+func ExprCoalesce(args []Expr) Expr {
+	return Expr{nextEID(), fmt.Sprintf("coalesce(%v)", names(args)), func() []Op {
+		code := args[len(args)-1].Code()
+		for i := len(args) - 2; i > -1; i-- {
+			arg := append(args[i].Code(), OpCoalesce(len(code)+1))
+			code = append(arg, code...)
+		}
+
+		return code
+	}, nil}
 }
 
 func (e Expr) Field(name string, pos *int) Expr {
-	return Expr{nextEID(), fmt.Sprintf("%v.%v", e.Name, name), func() []Op {
-		return append(e.Code(), OpGet(*pos))
-	}}
+	field := fmt.Sprintf("%v.%v", e.Name, name)
+	return Expr{nextEID(), field, func() []Op {
+		return append(e.Code(), named(OpGet(*pos), field))
+	}, nil}
 }
 
 func (e Expr) Index(name string, pos *int) Expr {
-	return Expr{nextEID(), fmt.Sprintf("%v[%v]", e.Name, name), func() []Op {
-		return append(e.Code(), OpIndex(*pos))
-	}}
+	index := fmt.Sprintf("%v[%v]", e.Name, name)
+	return Expr{nextEID(), index, func() []Op {
+		return append(e.Code(), named(OpIndex(*pos), index))
+	}, nil}
 }
 
 func (l Expr) Binary(r Expr, op Op, name string) Expr {
-	return Expr{nextEID(), fmt.Sprintf("%v %v %v", l.Name, name, r.Name), func() []Op {
+	name = fmt.Sprintf("%v %v %v", operand(l), name, operand(r))
+	return Expr{nextEID(), name, func() []Op {
 		lc := l.Code()
 		rc := r.Code()
 		code := make([]Op, len(rc)+len(lc)+1)
 		copy(code, rc)
 		copy(code[len(rc):], lc)
-		code[len(code)-1] = op
+		code[len(code)-1] = named(op, name)
 
 		return code
-	}}
+	}, []Expr{l, r}}
+}
+
+// Logical evaluates the right operand only if the left one does not decide
+// the result on its own (false for &&, true for ||).
+func (l Expr) Logical(r Expr, and bool) Expr {
+	name := "||"
+	if and {
+		name = "&&"
+	}
+
+	return Expr{nextEID(), fmt.Sprintf("%v %v %v", operand(l), name, operand(r)), func() []Op {
+		rc := r.Code()
+		code := l.Code()
+		if and {
+			code = append(code, OpAnd(len(rc)+2))
+		} else {
+			code = append(code, OpOr(len(rc)+2))
+		}
+		code = append(code, rc...)
+
+		return append(code, OpBool())
+	}, []Expr{l, r}}
 }
 
 func (e Expr) Unary(op Op, name string) Expr {
-	return Expr{nextEID(), fmt.Sprintf("%v%v", name, e.Name), func() []Op {
-		return append(e.Code(), op)
-	}}
+	name = fmt.Sprintf("%v%v", name, operand(e))
+	return Expr{nextEID(), name, func() []Op {
+		return append(e.Code(), named(op, name))
+	}, nil}
+}
+
+// Is tests whether the value of the expression is of the kind (or not).
+func (e Expr) Is(kind int, not bool) Expr {
+	name := fmt.Sprintf("%v is %v", operand(e), kinds[kind])
+	if not {
+		name = fmt.Sprintf("%v is not %v", operand(e), kinds[kind])
+	}
+
+	return Expr{nextEID(), name, func() []Op {
+		code := append(e.Code(), OpIs(kind))
+		if not {
+			code = append(code, OpNot())
+		}
+
+		return code
+	}, nil}
 }
 
 func (e Expr) Match(pattern string, re int) Expr {
-	name := fmt.Sprintf("%v =~ %v", e.Name, strconv.Quote(pattern))
+	name := fmt.Sprintf("%v =~ %v", operand(e), strconv.Quote(pattern))
 	return Expr{nextEID(), name, func() []Op {
 		return append(e.Code(), OpMatch(re))
-	}}
+	}, nil}
 }
 
-func ExprCall(fn int, args []Expr) Expr {
-	// TODO: compose a name
-	return Expr{nextEID(), "", func() []Op {
+func ExprCall(name string, fn int, args []Expr) Expr {
+	call := fmt.Sprintf("%v(%v)", name, names(args))
+	return Expr{nextEID(), call, func() []Op {
 		code := make([]Op, 0)
 		for i := len(args) - 1; i > -1; i-- {
-			for _, c := range args[i].Code() {
-				code = append(code, c)
-			}
+			code = append(code, args[i].Code()...)
 		}
 
-		return append(code, OpCall(fn))
-	}}
+		return append(code, named(OpCall(fn), call))
+	}, nil}
+}
+
+// operand returns the name of an operand of another expression (in
+// parentheses if it is a binary expression itself).
+func operand(e Expr) string {
+	if e.Args != nil {
+		return "(" + e.Name + ")"
+	}
+
+	return e.Name
+}
+
+// named attaches the name of an expression to its instruction (reported in
+// runtime errors).
+func named(op Op, name string) Op {
+	op.Name = name
+	return op
 }
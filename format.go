@@ -0,0 +1,262 @@
+// Copyright (c) 2013 Ostap Cherkashin. You can use this source code
+// under the terms of the MIT License found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Writer writes the result of a program in one of the output formats. A list
+// result is written an element at a time, other results are written as a
+// single element.
+type Writer interface {
+	Write(v Value) error
+	Close() error
+}
+
+type jsonWriter struct {
+	w     io.Writer
+	t     Type
+	list  bool
+	count int
+}
+
+type jsonlWriter struct {
+	w io.Writer
+	t Type
+}
+
+// csvWriter writes a row per element (with the field names of objects as the
+// header), it is also used for tab separated values.
+type csvWriter struct {
+	w    *csv.Writer
+	t    Type
+	head bool
+}
+
+// tableWriter aligns the columns of csv rows for terminals.
+type tableWriter struct {
+	w    *tabwriter.Writer
+	t    Type
+	head bool
+}
+
+var formats = []string{"json", "jsonl", "csv", "tsv", "table"}
+
+var blanks = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// NewWriter creates a writer of the format for a result of type t.
+func NewWriter(format string, w io.Writer, t Type) (Writer, error) {
+	elem, list := t, false
+	if lt, isList := t.(ListType); isList {
+		elem, list = lt.Elem, true
+	}
+
+	switch format {
+	case "json":
+		return &jsonWriter{w, t, list, 0}, nil
+	case "jsonl":
+		return &jsonlWriter{w, elem}, nil
+	case "csv", "tsv":
+		cw := csv.NewWriter(w)
+		if format == "tsv" {
+			cw.Comma = '\t'
+		}
+
+		return &csvWriter{cw, elem, false}, nil
+	case "table":
+		return &tableWriter{tabwriter.NewWriter(w, 0, 8, 2, ' ', 0), elem, false}, nil
+	}
+
+	return nil, checkFormat(format)
+}
+
+// checkFormat returns an error if the output format is not supported.
+func checkFormat(format string) error {
+	for _, f := range formats {
+		if f == format {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown output format %v (use one of %v)", format, strings.Join(formats, ", "))
+}
+
+func (j *jsonWriter) Write(v Value) error {
+	if !j.list {
+		return v.Quote(j.w, j.t)
+	}
+
+	sep := "["
+	if j.count > 0 {
+		sep = ","
+	}
+	j.count++
+
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+
+	return v.Quote(j.w, j.t.(ListType).Elem)
+}
+
+func (j *jsonWriter) Close() error {
+	end := "\n"
+	if j.list && j.count == 0 {
+		end = "[]\n"
+	} else if j.list {
+		end = "]\n"
+	}
+
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+func (j *jsonlWriter) Write(v Value) error {
+	if err := v.Quote(j.w, j.t); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(j.w, "\n")
+	return err
+}
+
+func (j *jsonlWriter) Close() error {
+	return nil
+}
+
+func (c *csvWriter) Write(v Value) error {
+	if !c.head {
+		c.head = true
+		if names := header(c.t); names != nil {
+			if err := c.w.Write(names); err != nil {
+				return err
+			}
+		}
+	}
+
+	row, err := cells(v, c.t)
+	if err != nil {
+		return err
+	}
+
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Close() error {
+	if names := header(c.t); !c.head && names != nil {
+		c.w.Write(names)
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (t *tableWriter) Write(v Value) error {
+	if !t.head {
+		t.head = true
+		if names := header(t.t); names != nil {
+			if err := t.row(names); err != nil {
+				return err
+			}
+
+			lines := make([]string, len(names))
+			for i, n := range names {
+				lines[i] = strings.Repeat("-", len(n))
+			}
+
+			if err := t.row(lines); err != nil {
+				return err
+			}
+		}
+	}
+
+	row, err := cells(v, t.t)
+	if err != nil {
+		return err
+	}
+
+	return t.row(row)
+}
+
+func (t *tableWriter) row(cells []string) error {
+	for i, c := range cells {
+		cells[i] = blanks.Replace(c)
+	}
+
+	_, err := fmt.Fprintf(t.w, "%v\n", strings.Join(cells, "\t"))
+	return err
+}
+
+func (t *tableWriter) Close() error {
+	return t.w.Flush()
+}
+
+// header returns the field names of an object type (nil for other types).
+func header(t Type) []string {
+	ot, isObject := narrow(t, "object").(ObjectType)
+	if !isObject {
+		return nil
+	}
+
+	names := make([]string, 0, len(ot))
+	for _, f := range ot {
+		if !hidden(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+
+	return names
+}
+
+// cells converts the fields of an object (or any other value) into text.
+func cells(v Value, t Type) ([]string, error) {
+	ot, isObject := narrow(t, "object").(ObjectType)
+	if obj, ok := v.(Object); ok && isObject {
+		res := make([]string, 0, len(obj))
+		for i, f := range obj {
+			if hidden(ot[i].Name) {
+				continue
+			}
+
+			c, err := cell(f, ot[i].Type)
+			if err != nil {
+				return nil, err
+			}
+
+			res = append(res, c)
+		}
+
+		return res, nil
+	}
+
+	c, err := cell(v, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{c}, nil
+}
+
+// cell writes strings as they are, nulls as blanks and the rest as JSON.
+func cell(v Value, t Type) (string, error) {
+	switch s := v.(type) {
+	case Null:
+		return "", nil
+	case String:
+		return string(s), nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := v.Quote(buf, t); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -14,6 +14,15 @@ type Func struct {
 	Eval func(s *Stack)
 }
 
+// FuncLayout converts the values of type t into the layout of the type want
+// (it cannot be called by name, see Decls.UseLayout).
+func FuncLayout(t, want Type) *Func {
+	ft := FuncType{want, []Type{t}}
+	return &Func{"", ft, func(s *Stack) {
+		s.Push(relayout(s.Pop(), t, want))
+	}}
+}
+
 func FuncTrunc() *Func {
 	t := FuncType{ScalarType(0), []Type{ScalarType(0)}}
 	return &Func{"trunc", t, func(s *Stack) {
@@ -84,3 +93,93 @@ func FuncReplace() *Func {
 		s.PushStr(str)
 	}}
 }
+
+func FuncCount() *Func {
+	t := FuncType{ScalarType(0), []Type{ListType{}}}
+	return &Func{"count", t, func(s *Stack) {
+		list := s.PopList()
+		s.PushNum(float64(len(list)))
+	}}
+}
+
+// number converts an element of a list added up by sum or avg, the strings
+// which are not numbers are errors.
+func number(v Value) float64 {
+	if str, isString := v.(String); isString {
+		if _, ok := parseNum(string(str)); !ok {
+			raise("", "'%v' is not a number", str)
+		}
+	}
+
+	return float64(v.Number())
+}
+
+func FuncSum() *Func {
+	t := FuncType{ScalarType(0), []Type{ListType{ScalarType(0)}}}
+	return &Func{"sum", t, func(s *Stack) {
+		list := s.PopList()
+		sum := 0.0
+		for _, v := range list {
+			if !isNull(v) {
+				sum += number(v)
+			}
+		}
+		s.PushNum(sum)
+	}}
+}
+
+func FuncAvg() *Func {
+	t := FuncType{ScalarType(0), []Type{ListType{ScalarType(0)}}}
+	return &Func{"avg", t, func(s *Stack) {
+		list := s.PopList()
+		sum, count := 0.0, 0
+		for _, v := range list {
+			if !isNull(v) {
+				sum += number(v)
+				count++
+			}
+		}
+
+		if count == 0 {
+			s.Push(Nil)
+		} else {
+			s.PushNum(sum / float64(count))
+		}
+	}}
+}
+
+func FuncMin() *Func {
+	t := FuncType{ScalarType(0), []Type{ListType{ScalarType(0)}}}
+	return &Func{"min", t, func(s *Stack) {
+		list := s.PopList()
+		val := Nil
+		for _, v := range list {
+			if isNull(v) {
+				continue
+			}
+
+			if isNull(val) || compare(v, val) < 0 {
+				val = v
+			}
+		}
+		s.Push(val)
+	}}
+}
+
+func FuncMax() *Func {
+	t := FuncType{ScalarType(0), []Type{ListType{ScalarType(0)}}}
+	return &Func{"max", t, func(s *Stack) {
+		list := s.PopList()
+		val := Nil
+		for _, v := range list {
+			if isNull(v) {
+				continue
+			}
+
+			if isNull(val) || compare(v, val) > 0 {
+				val = v
+			}
+		}
+		s.Push(val)
+	}}
+}
@@ -18,17 +18,22 @@ var gDecls *Decls
 var gLex   *lexer
 
 var gLID   int
+var gGID   int
 var gExpr  Expr
 var gError *ParseError
+var gComps map[int64]*Loop
 %}
 
 %union {
 	str   string
 	num   float64
 	bin   bool
+	kind  int
 	expr  Expr
 	exprs []Expr
 	loop  *Loop
+	order *Order
+	pos   scanner.Position
 }
 
 %token EQ	// "=="
@@ -43,6 +48,23 @@ var gError *ParseError
 %token OR	// "||"
 %token TRUE	// "true"
 %token FALSE	// "false"
+%token GROUP	// "group"
+%token BY	// "by"
+%token INTO	// "into"
+%token ORDER	// "order"
+%token ASC	// "asc"
+%token DESC	// "desc"
+%token LIMIT	// "limit"
+%token OFFSET	// "offset"
+%token LET	// "let"
+%token IN	// "in"
+%token IF	// "if"
+%token THEN	// "then"
+%token ELSE	// "else"
+%token NULL	// "null"
+%token IS	// "is"
+%token NOT	// "not"
+%token COALESCE	// "coalesce"
 
 %token <num> NUMBER
 %token <str> IDENT
@@ -55,6 +77,8 @@ var gError *ParseError
 %type <expr>	additive_expression
 %type <expr>	relational_expression
 %type <expr>	equality_expression
+%type <expr>	logical_expression
+%type <expr>	let_binding
 %type <expr>	expression
 %type <exprs>	expression_list
 %type <exprs>	expression_list_or_empty
@@ -62,6 +86,12 @@ var gError *ParseError
 %type <exprs>	object_field_list
 %type <bin>	generator
 %type <loop>	generator_list
+%type <order>	modifier
+%type <order>	modifier_list
+%type <bin>	direction
+%type <kind>	kind
+%type <str>	name
+%type <str>	field_name
 
 %start program
 
@@ -79,31 +109,54 @@ primary_expression:
 	{
 		addr, _ := gDecls.Declare("", String($1), ScalarType(0))
 		$$ = ExprLoad(strconv.Quote($1), addr)
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | NUMBER
 	{
 		addr, _ := gDecls.Declare("", Number($1), ScalarType(0))
 		$$ = ExprLoad(fmt.Sprintf("%v", $1), addr)
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | TRUE
 	{
 		addr, _ := gDecls.Declare("", Bool(true), ScalarType(0))
 		$$ = ExprLoad("true", addr)
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | FALSE
 	{
 		addr, _ := gDecls.Declare("", Bool(false), ScalarType(0))
 		$$ = ExprLoad("false", addr)
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
-    | IDENT
+    | NULL
+	{
+		addr, _ := gDecls.Declare("", Nil, NullType(0))
+		$$ = ExprLoad("null", addr)
+		gDecls.SetType($$, NullType(0), $<pos>$)
+	}
+    | COALESCE '(' expression_list ')'
+	{
+		eids := make(TypeOfCommon, len($3))
+		for i, e := range $3 {
+			eids[i] = e.Id
+			$3[i] = ExprLayout(e, gDecls.UseLayout(e.Id))
+		}
+		$$ = ExprCoalesce($3)
+		gDecls.SetType($$, eids, $<pos>$)
+	}
+    | name
 	{
-		addr := gDecls.UseIdent($1)
+		addr := gDecls.UseIdent($1, $<pos>1)
 		$$ = ExprLoad($1, addr)
-		gDecls.SetType($$, TypeOfIdent($1))
+		gDecls.SetType($$, TypeOfIdent($1), $<pos>$)
+	}
+    | IN
+	{
+		/* stdin (e.g. -f @json) is available as 'in' */
+		addr := gDecls.UseIdent("in", $<pos>1)
+		$$ = ExprLoad("in", addr)
+		gDecls.SetType($$, TypeOfIdent("in"), $<pos>$)
 	}
     | '{' object_field_list '}'
 	{
@@ -113,26 +166,25 @@ primary_expression:
 			ot[i].Name = f.Name
 		}
 		$$ = ExprObject($2)
-		gDecls.SetType($$, ot)
+		gDecls.SetType($$, ot, $<pos>$)
 	}
     | '[' expression_list ']'
 	{
-		eids := make([]int64, 0)
-		for _, e := range $2 {
-			eids = append(eids, e.Id)
+		eids := make(TypeOfUnion, len($2))
+		for i, e := range $2 {
+			eids[i] = e.Id
+			$2[i] = ExprLayout(e, gDecls.UseLayout(e.Id))
 		}
 		$$ = ExprList($2)
-		gDecls.SameType(eids)
-		gDecls.SetType($$, ListType{TypeOfExpr(eids[0])})
+		gDecls.SetType($$, ListType{eids}, $<pos>$)
 	}
     | '[' expression '|' generator_list ']'
 	{
-		gDecls.Strict(false)
-		resType := ListType{TypeOfExpr($2.Id)}
-		resAddr, _ := gDecls.Declare("", nil, resType)
-		loop := $4.Return($2, resAddr)
-		$$ = ExprComp(loop, resAddr)
-		gDecls.SetType($$, resType)
+		$$ = comprehension($2, $4, $<pos>$)
+	}
+    | '[' expression '|' generator_list ',' modifier_list ']'
+	{
+		$$ = comprehension($2, $4.OrderBy($6), $<pos>$)
 	}
     | '(' expression ')'
 	{
@@ -141,7 +193,7 @@ primary_expression:
     ;
 
 generator_list:
-      IDENT generator expression
+      name generator expression
 	{
 		gDecls.Strict(true)
 		varAddr, err := gDecls.Declare($1, nil, TypeOfElem($3.Id))
@@ -154,8 +206,11 @@ generator_list:
     | generator_list ',' expression
 	{
 		$$ = $1.Select($3)
+		if $$.Join(gGID, $3) {
+			gGID++
+		}
 	}
-    | generator_list ',' IDENT generator expression
+    | generator_list ',' name generator expression
 	{
 		varAddr, err := gDecls.Declare($3, nil, TypeOfElem($5.Id))
 		if err != nil {
@@ -164,6 +219,48 @@ generator_list:
 		$$ = $1.Nest(gLID, varAddr, $5, $4)
 		gLID++
 	}
+    | generator_list ',' name '=' expression
+	{
+		varAddr, err := gDecls.Declare($3, nil, TypeOfExpr($5.Id))
+		if err != nil {
+			parseError("%v", err)
+		}
+		$$ = $1.Bind(varAddr, $5)
+	}
+    | generator_list ',' GROUP expression BY name '=' expression INTO name
+	{
+		keyAddr, err := gDecls.Declare($6, nil, TypeOfExpr($8.Id))
+		if err != nil {
+			parseError("%v", err)
+		}
+
+		elemsType := ListType{TypeOfExpr($4.Id)}
+		elemsAddr, err := gDecls.Declare($10, nil, elemsType)
+		if err != nil {
+			parseError("%v", err)
+		}
+
+		groupType := ObjectType{{"key", TypeOfExpr($8.Id)}, {"elems", elemsType}}
+		groupAddr, _ := gDecls.Declare("", nil, groupType)
+
+		if $1.Parallel() {
+			gDecls.err($<pos>3, "group by cannot be used with parallel generators (<~)")
+		}
+		for _, v := range $1.Hidden($4, $8) {
+			gDecls.err($<pos>3, "'%v' is not available after group by", gDecls.idents[v])
+		}
+
+		groups := ExprGroup($1.Group(gGID, $4, $8), gGID)
+		gDecls.SetType(groups, ListType{groupType}, $<pos>3)
+		gGID++
+
+		keyPos, elemsPos := 0, 1
+		group := ExprLoad("", groupAddr)
+		$$ = ForEach(gLID, groupAddr, groups, false).Hide($1)
+		$$.Bind(keyAddr, group.Field("key", &keyPos))
+		$$.Bind(elemsAddr, group.Field("elems", &elemsPos))
+		gLID++
+	}
     ;
 
 generator:
@@ -171,6 +268,96 @@ generator:
     | PROD_PAR { $$ = true }
     ;
 
+modifier_list:
+      modifier
+	{
+		$$ = $1
+	}
+    | modifier_list ',' modifier
+	{
+		$$ = $1.Merge($3)
+	}
+    ;
+
+modifier:
+      ORDER BY expression direction
+	{
+		$$ = OrderBy($3, $4)
+	}
+    | LIMIT NUMBER
+	{
+		$$ = Limit(int($2))
+	}
+    | OFFSET NUMBER
+	{
+		$$ = Offset(int($2))
+	}
+    ;
+
+kind:
+      NULL
+	{
+		$$ = 0
+	}
+    | IDENT
+	{
+		$$ = -1
+		for i, k := range kinds {
+			if k == $1 {
+				$$ = i
+			}
+		}
+
+		if $$ < 0 {
+			parseError("unknown kind '%v' (use one of null, scalar, list, object)", $1)
+			$$ = 0
+		}
+	}
+    ;
+
+direction:
+	{
+		$$ = false
+	}
+    | ASC
+	{
+		$$ = false
+	}
+    | DESC
+	{
+		$$ = true
+	}
+    ;
+
+/* keywords which are not ambiguous in place of identifiers */
+name:
+      IDENT
+    | BY { $$ = "by" }
+    | INTO { $$ = "into" }
+    | ORDER { $$ = "order" }
+    | ASC { $$ = "asc" }
+    | DESC { $$ = "desc" }
+    | LIMIT { $$ = "limit" }
+    | OFFSET { $$ = "offset" }
+    | IS { $$ = "is" }
+    | NOT { $$ = "not" }
+    ;
+
+/* any of the keywords can name a field of an object literal */
+field_name:
+      name
+    | TRUE { $$ = "true" }
+    | FALSE { $$ = "false" }
+    | GROUP { $$ = "group" }
+    | IN { $$ = "in" }
+    | IF { $$ = "if" }
+    | THEN { $$ = "then" }
+    | ELSE { $$ = "else" }
+    | NULL { $$ = "null" }
+    | LET { $$ = "let" }
+    | COALESCE { $$ = "coalesce" }
+    ;
+
 object_field_list:
       object_field
 	{
@@ -187,9 +374,9 @@ object_field:
 	{
 		$$ = $1
 	}
-    | IDENT ':' expression
+    | field_name ':' expression
 	{
-		$$ = Expr{$3.Id, $1, $3.Code}
+		$$ = Expr{$3.Id, $1, $3.Code, $3.Args}
 	}
     ;
 
@@ -223,19 +410,19 @@ postfix_expression:
 	{
 		pos := gDecls.UseField($1.Id, $3)
 		$$ = $1.Field($3, pos)
-		gDecls.SetType($$, TypeOfField{$1.Id, $3})
+		gDecls.SetType($$, TypeOfField{$1.Id, $3}, $<pos>$)
 	}
     | postfix_expression '[' STRING ']'
 	{
 		pos := gDecls.UseField($1.Id, $3)
 		$$ = $1.Field($3, pos)
-		gDecls.SetType($$, TypeOfField{$1.Id, $3})
+		gDecls.SetType($$, TypeOfField{$1.Id, $3}, $<pos>$)
 	}
     | postfix_expression '[' NUMBER ']'
 	{
 		pos := int($3)
-		$$ = $1.Index(fmt.Sprintf("%f",$3), &pos)
-		gDecls.SetType($$, TypeOfElem($1.Id))
+		$$ = $1.Index(fmt.Sprintf("%v", $3), &pos)
+		gDecls.SetType($$, TypeOfElem($1.Id), $<pos>$)
 	}
     | postfix_expression '(' expression_list_or_empty ')'
 	{
@@ -243,10 +430,10 @@ postfix_expression:
 		for i, e := range $3 {
 			eids[i] = e.Id
 		}
-		fn := gDecls.UseFunc($1.Name, eids)
+		fn := gDecls.UseFunc($1.Name, eids, $<pos>1)
 		if fn > -1 {
-			$$ = ExprCall(fn, $3)
-			gDecls.SetType($$, TypeOfFunc($1.Name))
+			$$ = ExprCall($1.Name, fn, $3)
+			gDecls.SetType($$, TypeOfFunc($1.Name), $<pos>$)
 		}
 	}
     ;
@@ -259,17 +446,17 @@ unary_expression:
     | '!' postfix_expression
 	{
 		$$ = $2.Unary(OpNot(), "!")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | '-' postfix_expression
 	{
 		$$ = $2.Unary(OpNeg(), "-")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | '+' postfix_expression
 	{
 		$$ = $2.Unary(OpPos(), "+")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     ;
 
@@ -281,12 +468,12 @@ multiplicative_expression:
     | multiplicative_expression '*' unary_expression
 	{
 		$$ = $1.Binary($3, OpMul(), "*")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | multiplicative_expression '/' unary_expression
 	{
 		$$ = $1.Binary($3, OpDiv(), "/")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     ;
 
@@ -298,17 +485,17 @@ additive_expression:
     | additive_expression '+' multiplicative_expression
 	{
 		$$ = $1.Binary($3, OpAdd(), "+")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | additive_expression '-' multiplicative_expression
 	{
 		$$ = $1.Binary($3, OpSub(), "-")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | additive_expression CAT multiplicative_expression
 	{
 		$$ = $1.Binary($3, OpCat(), "++")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     ;
 
@@ -320,22 +507,22 @@ relational_expression:
     | relational_expression '<' additive_expression
 	{
 		$$ = $1.Binary($3, OpLT(), "<")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | relational_expression '>' additive_expression
 	{
 		$$ = $1.Binary($3, OpGT(), ">")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | relational_expression LTE additive_expression
 	{
 		$$ = $1.Binary($3, OpLTE(), "<=")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | relational_expression GTE additive_expression
 	{
 		$$ = $1.Binary($3, OpGTE(), ">=")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     ;
 
@@ -347,48 +534,92 @@ equality_expression:
     | equality_expression EQ relational_expression
 	{
 		$$ = $1.Binary($3, OpEq(), "==")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | equality_expression NEQ relational_expression
 	{
 		$$ = $1.Binary($3, OpNEq(), "!=")
-		gDecls.SetType($$, ScalarType(0))
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
+	}
+    | equality_expression IS kind
+	{
+		$$ = $1.Is($3, false)
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
+	}
+    | equality_expression IS NOT kind
+	{
+		$$ = $1.Is($4, true)
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
 	}
     | equality_expression MATCH STRING
 	{
 		re, err := gDecls.RegExp($3)
 		if err == nil {
 			$$ = $1.Match($3, re)
-			gDecls.SetType($$, ScalarType(0))
+			gDecls.SetType($$, ScalarType(0), $<pos>$)
 		} else {
 			parseError("%v", err)
 		}
 	}
     ;
 
-expression:
+logical_expression:
       equality_expression
 	{
 		$$ = $1
 	}
-    | expression AND equality_expression
+    | logical_expression AND equality_expression
+	{
+		$$ = $1.Logical($3, true)
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
+	}
+    | logical_expression OR equality_expression
+	{
+		$$ = $1.Logical($3, false)
+		gDecls.SetType($$, ScalarType(0), $<pos>$)
+	}
+    ;
+
+let_binding:
+      LET name '=' expression
+	{
+		addr, err := gDecls.Bind($2, TypeOfExpr($4.Id))
+		if err != nil {
+			parseError("%v", err)
+		}
+		$$ = ExprBind($2, $4, addr)
+	}
+    ;
+
+expression:
+      logical_expression
+	{
+		$$ = $1
+	}
+    | let_binding IN expression
 	{
-		$$ = $1.Binary($3, OpAnd(), "&&")
-		gDecls.SetType($$, ScalarType(0))
+		$$ = ExprLet($1, $3)
+		gDecls.SetType($$, TypeOfExpr($3.Id), $<pos>$)
+		gDecls.Pop()
 	}
-    | expression OR equality_expression
+    | IF expression THEN expression ELSE expression
 	{
-		$$ = $1.Binary($3, OpOr(), "||")
-		gDecls.SetType($$, ScalarType(0))
+		t := ExprLayout($4, gDecls.UseLayout($4.Id))
+		e := ExprLayout($6, gDecls.UseLayout($6.Id))
+		$$ = ExprCond($2, t, e)
+		gDecls.SetType($$, TypeOfCommon{$4.Id, $6.Id}, $<pos>$)
 	}
     ;
 
 %%
 
+// ParseError is the first error found in an expression, the others (ordered
+// by their positions) are in More.
 type ParseError struct {
-	Line    int    `json:"line"`
-	Column  int    `json:"column"`
-	Message string `json:"error"`
+	Line    int           `json:"line"`
+	Column  int           `json:"column"`
+	Message string        `json:"error"`
+	More    []*ParseError `json:"more,omitempty"`
 }
 
 func (e *ParseError) Error() string {
@@ -399,23 +630,71 @@ func (e *ParseError) Error() string {
 	return "<ParseError:nil>"
 }
 
+// Snippet returns the line of the expression with the error and a caret
+// under its column (or an empty string if the position is unknown).
+func (e *ParseError) Snippet(expr string) string {
+	lines := strings.Split(expr, "\n")
+	if e.Line < 1 || e.Line > len(lines) {
+		return ""
+	}
+
+	line := []rune(strings.TrimRight(lines[e.Line-1], "\r"))
+	caret := make([]rune, 0, len(line))
+	for i := 0; i < e.Column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+
+	return fmt.Sprintf("  %v\n  %v^", string(line), string(caret))
+}
+
 func NewError(line, column int, msg string, args ...interface{}) *ParseError {
 	return &ParseError{Line: line, Column: column, Message: fmt.Sprintf(msg, args...)}
 }
 
+var keywords = map[string]int{
+	"true":     TRUE,
+	"false":    FALSE,
+	"group":    GROUP,
+	"by":       BY,
+	"into":     INTO,
+	"order":    ORDER,
+	"asc":      ASC,
+	"desc":     DESC,
+	"limit":    LIMIT,
+	"offset":   OFFSET,
+	"let":      LET,
+	"in":       IN,
+	"if":       IF,
+	"then":     THEN,
+	"else":     ELSE,
+	"null":     NULL,
+	"is":       IS,
+	"not":      NOT,
+	"coalesce": COALESCE,
+}
+
 type lexer struct {
 	scan scanner.Scanner
+	prev int
 }
 
 func (l *lexer) Lex(yylval *comp_SymType) int {
+	l.prev = l.next(yylval)
+	yylval.pos = l.scan.Position /* of the token (inherited by the rules starting with it) */
+	return l.prev
+}
+
+func (l *lexer) next(yylval *comp_SymType) int {
 	tok := l.scan.Scan()
 	switch tok {
 	case scanner.Ident:
 		ident := l.scan.TokenText()
-		if ident == "true" {
-			return TRUE
-		} else if ident == "false" {
-			return FALSE
+		if kw, ok := keywords[ident]; ok && l.prev != '.' {
+			return kw
 		}
 
 		yylval.str = ident
@@ -495,6 +774,21 @@ func (l *lexer) Error(s string) {
 	parseError(s)
 }
 
+func comprehension(expr Expr, loop *Loop, pos scanner.Position) Expr {
+	gDecls.Strict(false)
+	for _, v := range loop.Hidden(expr) {
+		gDecls.err(pos, "'%v' is not available after group by", gDecls.idents[v])
+	}
+
+	resType := ListType{TypeOfExpr(expr.Id)}
+	resAddr, _ := gDecls.Declare("", nil, resType)
+	res := ExprComp(loop.Return(expr, resAddr), resAddr)
+	gDecls.SetType(res, resType, pos)
+	gComps[res.Id] = loop
+
+	return res
+}
+
 func parseError(s string, v ...interface{}) {
 	gError = NewError(gLex.scan.Pos().Line, gLex.scan.Pos().Column, s, v...)
 }
@@ -504,6 +798,8 @@ func Compile(expr string, decls *Decls) (*Program, Type, *ParseError) {
 	defer gMutex.Unlock()
 
 	gLID = 0
+	gGID = 0
+	gComps = make(map[int64]*Loop)
 	gDecls = decls
 	gLex = &lexer{}
 
@@ -518,11 +814,19 @@ func Compile(expr string, decls *Decls) (*Program, Type, *ParseError) {
 	if gError == nil {
 		resType, errors := gDecls.Verify(gExpr.Id)
 		if len(errors) > 0 {
-			gError = NewError(0, 0, "%v", errors[0])
+			gError = errors[0]
+			gError.More = errors[1:]
 		} else {
+			var out *emitter
+			if loop := gComps[gExpr.Id]; loop != nil && loop.Emit() {
+				out = new(emitter)
+			}
+
 			code := gExpr.Code()
 			loops := make([]*iterator, gLID)
-			prog = &Program{code, gDecls.values, gDecls.regexps, gDecls.funcs, loops}
+			groups := make([]*buckets, gGID)
+			prog = &Program{code, gDecls.values, gDecls.regexps, gDecls.funcs, loops, groups, out, nil, DefaultLimits()}
+			prog.collect()
 		}
 
 		return prog, resType, gError
@@ -33,17 +33,96 @@ type Loop struct {
 	resAddr  int
 	varAddr  int
 	list     Expr
-	sel      []Expr
+	sel      []clause
 	ret      Expr
+	key      Expr
+	gid      int
+	order    *Order
+	stop     int
+	builds   []*Loop
+	joined   bool
 	parallel bool
+	emit     bool
+	hidden   []int /* variables of the loops before a group by */
+}
+
+// clause is either a selection (addr < 0) or a binding of the expression
+// value to a variable at addr.
+type clause struct {
+	expr Expr
+	addr int
+}
+
+// Order describes the sorting of comprehension results by a list of keys
+// and the range (offset, limit) of the results to return.
+type Order struct {
+	keys   []Expr
+	desc   []bool
+	offset int
+	limit  int
 }
 
 func ForEach(lid int, varAddr int, list Expr, parallel bool) *Loop {
-	return &Loop{lid, nil, -1, varAddr, list, nil, BadExpr, parallel}
+	return &Loop{lid, nil, -1, varAddr, list, nil, BadExpr, BadExpr, -1, nil, 0, nil, false, parallel, false, nil}
+}
+
+func OrderBy(key Expr, desc bool) *Order {
+	return &Order{[]Expr{key}, []bool{desc}, 0, -1}
+}
+
+func Offset(n int) *Order {
+	return &Order{nil, nil, n, -1}
+}
+
+func Limit(n int) *Order {
+	return &Order{nil, nil, 0, n}
+}
+
+// Merge appends the keys of o2 to o and overrides the offset and limit of o
+// with the ones specified in o2.
+func (o *Order) Merge(o2 *Order) *Order {
+	o.keys = append(o.keys, o2.keys...)
+	o.desc = append(o.desc, o2.desc...)
+	if o2.offset > 0 {
+		o.offset = o2.offset
+	}
+	if o2.limit > -1 {
+		o.limit = o2.limit
+	}
+
+	return o
+}
+
+// Code sorts and slices the list of results from the top of the stack.
+func (o *Order) Code() []Op {
+	code := make([]Op, 0)
+	if len(o.keys) > 0 {
+		desc := 0
+		for i, d := range o.desc {
+			if d {
+				desc |= 1 << uint(i)
+			}
+		}
+		code = append(code, OpSort(desc))
+	}
+
+	if o.offset > 0 || o.limit > -1 {
+		code = append(code, OpArg(o.offset))
+		code = append(code, OpArg(o.limit))
+		code = append(code, OpSlice())
+	}
+
+	return code
 }
 
 func (l *Loop) Code() []Op {
-	code := l.list.Code()
+	code := make([]Op, 0)
+	for _, b := range l.builds { // hash tables for joins
+		code = append(code, OpBuckets(b.gid))
+		code = append(code, b.Code()...)
+	}
+
+	code = append(code, l.list.Code()...)
 	clen := l.codeLen(-1)
 
 	// jump over the loop
@@ -51,9 +130,10 @@ func (l *Loop) Code() []Op {
 	// jump back to beginning
 	nextJump := -clen
 
-	parallel := 0
+	// the parallel workers append to the result (see Program.parallel)
+	parallel := -1
 	if l.parallel {
-		parallel = 1
+		parallel = l.innermost().resAddr
 	}
 
 	code = append(code, OpArg(loopJump))
@@ -61,24 +141,20 @@ func (l *Loop) Code() []Op {
 	code = append(code, OpLoop(l.lid))
 	code = append(code, OpStore(l.varAddr))
 
-	for i, s := range l.sel { // select(s)
-		for _, c := range s.Code() {
-			code = append(code, c)
+	for i, s := range l.sel { // select(s) or bind(s)
+		code = append(code, s.expr.Code()...)
+
+		if s.addr < 0 {
+			code = append(code, OpTest(l.codeLen(i)))
+		} else {
+			code = append(code, OpStore(s.addr))
 		}
-		code = append(code, OpTest(l.codeLen(i)))
 	}
 
 	if l.inner != nil { // nested loop(s)
-		for _, c := range l.inner.Code() {
-			code = append(code, c)
-		}
+		code = append(code, l.inner.Code()...)
 	} else { // return
-		code = append(code, OpLoad(l.resAddr))
-		for _, c := range l.ret.Code() {
-			code = append(code, c)
-		}
-		code = append(code, OpAppend())
-		code = append(code, OpStore(l.resAddr))
+		code = append(code, l.body()...)
 	}
 
 	code = append(code, OpArg(nextJump))
@@ -86,22 +162,247 @@ func (l *Loop) Code() []Op {
 }
 
 func (l *Loop) Nest(lid int, varAddr int, list Expr, parallel bool) *Loop {
-	l.innermost().inner = &Loop{lid, nil, -1, varAddr, list, nil, BadExpr, parallel}
+	l.innermost().inner = ForEach(lid, varAddr, list, parallel)
 	return l
 }
 
+// Select attaches the selection to the outermost loop where all of the
+// variables it references are bound, so it is not re-evaluated by the nested
+// loops, e.g. [x | i <- a, j <- b, i.v > 3] tests i.v > 3 before iterating
+// over b.
 func (l *Loop) Select(expr Expr) *Loop {
-	i := l.innermost()
-	i.sel = append(i.sel, expr)
+	return l.attach(clause{expr, -1})
+}
+
+// Bind attaches the binding of expr to a variable (addr) the same way as
+// Select does.
+func (l *Loop) Bind(addr int, expr Expr) *Loop {
+	return l.attach(clause{expr, addr})
+}
+
+func (l *Loop) attach(c clause) *Loop {
+	vars := make(map[int]bool)
+	for i := l; i != nil; i = i.inner {
+		for _, v := range i.vars() {
+			vars[v] = true
+		}
+	}
+
+	deps := refs(c.expr, vars)
+	bound := make(map[int]bool)
+	for i := l; i != nil; i = i.inner {
+		for _, v := range i.vars() {
+			bound[v] = true
+		}
+
+		if i.inner == nil || within(deps, bound) {
+			i.sel = append(i.sel, c)
+			break
+		}
+	}
+
+	return l
+}
+
+// Join replaces the iteration over a list with the lookup in a hash table
+// (gid) if expr is an equality between a variable of a nested loop and the
+// variables of its outer loops (e.g. i.id == j.id). The hash table is built
+// once before the outermost loop, so the list of the nested loop must not
+// depend on the outer loops. The selection itself is kept to re-check the
+// matches. Join returns false if no such loop was found.
+func (l *Loop) Join(gid int, expr Expr) bool {
+	if len(expr.Args) != 2 {
+		return false
+	}
+
+	code := expr.Code()
+	if code[len(code)-1].Code != opEq {
+		return false
+	}
+
+	vars := make(map[int]bool) /* variables of all loops */
+	for i := l; i != nil; i = i.inner {
+		for _, v := range i.vars() {
+			vars[v] = true
+		}
+	}
+
+	bound := make(map[int]bool) /* variables of the outer loops */
+	for _, v := range l.vars() {
+		bound[v] = true
+	}
+
+	for i := l.inner; i != nil; i = i.inner {
+		if !i.parallel && !i.joined && !uses(i.list, bound) {
+			for k := 0; k < 2; k++ {
+				key, probe := expr.Args[k], expr.Args[1-k]
+
+				keyRefs := refs(key, vars)
+				if len(keyRefs) != 1 || !keyRefs[i.varAddr] || !within(refs(probe, vars), bound) {
+					continue
+				}
+
+				build := ForEach(i.lid, i.varAddr, i.list, false)
+				build.Group(gid, ExprLoad("", i.varAddr), key)
+
+				l.builds = append(l.builds, build)
+				i.list = ExprProbe(probe, gid)
+				i.joined = true
+				return true
+			}
+		}
+
+		for _, v := range i.vars() {
+			bound[v] = true
+		}
+	}
+
+	return false
+}
+
+// Group makes the loop collect the values of expr into hash buckets (gid)
+// by the value of key instead of appending them to a result. The loop must
+// not be parallel (see Parallel).
+func (l *Loop) Group(gid int, expr, key Expr) *Loop {
+	l.innermost().ret = expr
+	l.innermost().key = key
+	l.innermost().gid = gid
 	return l
 }
 
+// Hide makes the variables of the loops grouped by a group by clause (and
+// the ones hidden from them) unavailable in the loop over the groups.
+func (l *Loop) Hide(grouped *Loop) *Loop {
+	l.hidden = append(l.hidden, grouped.hidden...)
+	for i := grouped; i != nil; i = i.inner {
+		l.hidden = append(l.hidden, i.vars()...)
+	}
+
+	return l
+}
+
+// Hidden returns the addresses of the hidden variables (see Hide) used by
+// the expressions or the clauses of the loop.
+func (l *Loop) Hidden(exprs ...Expr) []int {
+	for i := l; i != nil; i = i.inner {
+		for _, b := range i.builds {
+			exprs = append(exprs, b.list)
+		}
+		if i != l {
+			exprs = append(exprs, i.list)
+		}
+		for _, s := range i.sel {
+			exprs = append(exprs, s.expr)
+		}
+	}
+	if l.order != nil {
+		exprs = append(exprs, l.order.keys...)
+	}
+
+	hidden := make(map[int]bool)
+	for _, v := range l.hidden {
+		hidden[v] = true
+	}
+
+	res := make([]int, 0)
+	for _, e := range exprs {
+		for _, op := range e.Code() {
+			if op.Code == opLoad && hidden[op.Arg] {
+				res = append(res, op.Arg)
+				delete(hidden, op.Arg)
+			}
+		}
+	}
+
+	return res
+}
+
+// Parallel checks if any of the iterations of the loop is computed in
+// parallel.
+func (l *Loop) Parallel() bool {
+	for i := l; i != nil; i = i.inner {
+		if i.parallel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Emit makes the loop write the results straight to the output instead of
+// appending them to a list (unless the results are sorted, sliced or
+// computed in parallel). Emit returns false if it is not possible.
+func (l *Loop) Emit() bool {
+	for i := l; i != nil; i = i.inner {
+		if i.parallel || i.order != nil {
+			return false
+		}
+	}
+
+	l.innermost().emit = true
+	return true
+}
+
 func (l *Loop) Return(expr Expr, resAddr int) *Loop {
 	l.innermost().ret = expr
 	l.innermost().resAddr = resAddr
 	return l
 }
 
+// OrderBy sorts and slices the results of the loop. Without the sort keys
+// the iteration stops as soon as the limit is reached.
+func (l *Loop) OrderBy(o *Order) *Loop {
+	depth := 0
+	for i := l; i != nil; i = i.inner {
+		depth++
+	}
+
+	l.order = o
+	l.innermost().order = o
+	l.innermost().stop = depth*2 /* OpArg + OpNext */ + 1 /* next instruction after the loop */
+	return l
+}
+
+// vars returns the addresses of the loop variable and the bound variables.
+func (l *Loop) vars() []int {
+	res := []int{l.varAddr}
+	for _, s := range l.sel {
+		if s.addr > -1 {
+			res = append(res, s.addr)
+		}
+	}
+
+	return res
+}
+
+// refs returns the addresses of vars loaded by the expression.
+func refs(e Expr, vars map[int]bool) map[int]bool {
+	res := make(map[int]bool)
+	for _, op := range e.Code() {
+		if op.Code == opLoad && vars[op.Arg] {
+			res[op.Arg] = true
+		}
+	}
+
+	return res
+}
+
+// within checks if all of the addresses are in vars.
+func within(addrs, vars map[int]bool) bool {
+	for a := range addrs {
+		if !vars[a] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// uses checks if the expression loads any of vars.
+func uses(e Expr, vars map[int]bool) bool {
+	return len(refs(e, vars)) > 0
+}
+
 func (l *Loop) innermost() *Loop {
 	i := l
 	for i.inner != nil {
@@ -121,14 +422,56 @@ func (l *Loop) codeLen(selPos int) int {
 	}
 
 	for i := selPos + 1; i < len(l.sel); i++ {
-		jump += len(l.sel[i].Code()) + 1 /* OpTest */
+		jump += len(l.sel[i].expr.Code()) + 1 /* OpTest or OpStore */
 	}
 
 	if l.inner != nil {
 		jump += len(l.inner.Code())
 	} else {
-		jump += 1 /* OpLoad */ + len(l.ret.Code()) + 1 /* OpAppend */ + 1 /* OpStore */
+		jump += len(l.body())
 	}
 
 	return jump + 1 /* OpArg */
 }
+
+// body of the innermost loop either adds the return value to hash buckets,
+// writes it to the output or appends it to the result (together with the
+// sort keys).
+func (l *Loop) body() []Op {
+	code := make([]Op, 0)
+	if l.gid > -1 { // bucket(key, ret)
+		code = append(code, l.key.Code()...)
+		code = append(code, l.ret.Code()...)
+
+		return append(code, OpBucket(l.gid))
+	}
+
+	if l.emit { // emit(ret)
+		code = append(code, l.ret.Code()...)
+
+		return append(code, OpEmit())
+	}
+
+	code = append(code, OpLoad(l.resAddr))
+	if l.order != nil && len(l.order.keys) > 0 { // append([ret, keys...])
+		code = append(code, OpList())
+		code = append(code, l.ret.Code()...)
+		code = append(code, OpAppend())
+		for _, k := range l.order.keys {
+			code = append(code, k.Code()...)
+			code = append(code, OpAppend())
+		}
+	} else { // append(ret)
+		code = append(code, l.ret.Code()...)
+	}
+	code = append(code, OpAppend())
+	code = append(code, OpStore(l.resAddr))
+
+	if l.order != nil && len(l.order.keys) == 0 && l.order.limit > -1 {
+		code = append(code, OpLoad(l.resAddr))
+		code = append(code, OpArg(l.order.offset+l.order.limit))
+		code = append(code, OpLimit(l.stop))
+	}
+
+	return code
+}
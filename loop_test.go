@@ -0,0 +1,240 @@
+// Copyright (c) 2013 Ostap Cherkashin. You can use this source code
+// under the terms of the MIT License found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func probes(t *testing.T, expr string) int {
+	prg, _, err := Compile(expr, NewDecls())
+	if err != nil {
+		t.Fatalf("%v: %v", expr, err)
+	}
+
+	count := 0
+	for _, op := range prg.code {
+		if op.Code == opProbe {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestJoin(t *testing.T) {
+	joins := []string{
+		"[{i, j} | i <- [1, 2], j <- [2, 3], i == j]",
+		"[{i, j} | i <- [1, 2], j <- [2, 3], j == i]",
+		"[{i, j} | i <- [{id: 1}], j <- [{id: 1}], i.id == j.id]",
+		"[{i, j} | i <- [1, 2], j <- [2, 3], i + 1 == j * 2]",
+		"[{i, j, k} | i <- [1, 2], j <- [2, 3], k <- [3, 4], i == k]",
+	}
+	for _, expr := range joins {
+		if n := probes(t, expr); n != 1 {
+			t.Errorf("%v: expected a join, got %d", expr, n)
+		}
+	}
+
+	loops := []string{
+		"[i | i <- [1, 2], i == 1]",
+		"[{i, j} | i <- [1, 2], j <- [i, 3], i == j]",
+		"[{i, j} | i <- [1, 2], j <- [2, 3], i != j]",
+		"[{i, j} | i <- [1, 2], j <- [2, 3], i == j && true]",
+		"[{i, j} | i <- [1, 2], j <- [2, 3], i + j == j]",
+		"[{i, j} | i <- [1, 2], j <~ [2, 3], i == j]",
+	}
+	for _, expr := range loops {
+		if n := probes(t, expr); n != 0 {
+			t.Errorf("%v: expected no joins, got %d", expr, n)
+		}
+	}
+}
+
+func TestPushdown(t *testing.T) {
+	tests := map[string]int{
+		"[i | i <- [1, 2], j <- [2, 3], i > 1]":                  1,
+		"[i | i <- [1, 2], j <- [2, 3], i > 1, i < j]":           1,
+		"[i | i <- [1, 2], j <- [2, 3], j > 1]":                  0,
+		"[i | i <- [1, 2], j <- [2, 3], true]":                   1,
+		"[i | i <- [1, 2], j <- [2, 3], k <- [4], i > 1, j > 2]": 2,
+	}
+
+	for expr, outer := range tests {
+		prg, _, err := Compile(expr, NewDecls())
+		if err != nil {
+			t.Fatalf("%v: %v", expr, err)
+		}
+
+		/* count the tests before the innermost loop */
+		count, seen := 0, 0
+		for _, op := range prg.code {
+			if op.Code == opTest {
+				seen++
+			} else if op.Code == opLoop {
+				count = seen
+			}
+		}
+
+		if count != outer {
+			t.Errorf("%v: expected %d outer tests, got %d", expr, outer, count)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		expr    string
+		streams bool
+		emits   bool
+	}{
+		{"[r | r <- rows, r > 1]", true, true},
+		{"[r | r <- rows, order by r]", true, false},
+		{"[r | r <- rows, limit 1]", true, false},
+		{"count([r | r <- rows])", true, false},
+		{"[r | r <~ rows]", false, false},
+		{"[{r, s} | r <- rows, s <- rows]", false, true},
+		{"[[r | r <- rows] | i <- [1, 2]]", false, true},
+		{"let x = rows in [r | r <- x]", false, false},
+		{"count(rows)", false, false},
+	}
+
+	for _, test := range tests {
+		values := make(chan Value, 3)
+		for i := 1; i < 4; i++ {
+			values <- Number(i)
+		}
+		close(values)
+		rows := NewBody(values, make(chan bool))
+
+		decls := NewDecls()
+		decls.AddFunc(FuncCount())
+		addr, _ := decls.Declare("rows", rows, ListType{ScalarType(0)})
+
+		prg, _, err := Compile(test.expr, decls)
+		if err != nil {
+			t.Fatalf("%v: %v", test.expr, err)
+		}
+
+		if _, isBody := prg.data[addr].(*Body); isBody != test.streams {
+			t.Errorf("%v: expected streaming %v, got %v", test.expr, test.streams, isBody)
+		}
+
+		if emits := prg.out != nil; emits != test.emits {
+			t.Errorf("%v: expected emitting %v, got %v", test.expr, test.emits, emits)
+		}
+	}
+}
+
+func TestStreamRelease(t *testing.T) {
+	values, stop, done := make(chan Value), make(chan bool), make(chan bool)
+	go func() { /* an endless loader */
+		defer close(done)
+		for _, i := range []int{1, 2, 0} {
+			select {
+			case values <- Number(i):
+			case <-stop:
+				return
+			}
+		}
+		<-stop
+	}()
+
+	decls := NewDecls()
+	decls.Declare("rows", NewBody(values, stop), ListType{ScalarType(0)})
+
+	expr := "[10 / r | r <- rows]"
+	prg, rt, err := Compile(expr, decls)
+	if err != nil {
+		t.Fatalf("%v: %v", expr, err)
+	}
+	if err := Exec(prg, rt, new(bytes.Buffer), "json"); err == nil {
+		t.Fatalf("%v: expected division by zero", expr)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("%v: the loader of the stream is not stopped", expr)
+	}
+}
+
+func TestStreamCollect(t *testing.T) {
+	values := make(chan Value, 3)
+	for i := 1; i < 4; i++ {
+		values <- Number(i)
+	}
+	close(values)
+	rows := NewBody(values, make(chan bool))
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"count(rows)", "3"},
+		{"rows", "[1,2,3]"},
+		{"count(rows)", "3"},
+	}
+
+	for _, test := range tests {
+		decls := NewDecls()
+		decls.AddFunc(FuncCount())
+		decls.Declare("rows", rows, ListType{ScalarType(0)})
+
+		prg, rt, err := Compile(test.expr, decls)
+		if err != nil {
+			t.Fatalf("%v: %v", test.expr, err)
+		}
+
+		got := new(bytes.Buffer)
+		if err := Exec(prg, rt, got, "json"); err != nil {
+			t.Fatalf("%v: %v", test.expr, err)
+		}
+
+		if res := strings.TrimSpace(got.String()); res != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.expr, test.expected, res)
+		}
+	}
+}
+
+func TestParallel(t *testing.T) {
+	nums := make([]string, 1000)
+	for i := range nums {
+		nums[i] = fmt.Sprintf("%d", (i*7919)%1000)
+	}
+	list := "[" + strings.Join(nums, ", ") + "]"
+
+	tests := []string{
+		"[i * 2 | i <~ %v]",
+		"[i | i <~ %v, trunc(i / 3) * 3 == i]",
+		"[{i, j} | i <- [1, 2, 3], j <~ %v, j < i * 10]",
+		"[i | i <~ %v, order by i, limit 10]",
+		"[i | i <~ %v, offset 10, limit 20]",
+		"[count([j | j <~ [i, i + 1, i + 2], j > 500]) | i <~ %v]",
+	}
+
+	for _, test := range tests {
+		seq := strings.Replace(test, "<~", "<-", -1)
+		for _, w := range []int{2, 3, 8} {
+			limits := DefaultLimits()
+			limits.Workers = w
+
+			expected, got := new(bytes.Buffer), new(bytes.Buffer)
+			if err := Eval(NewStore(), fmt.Sprintf(seq, list), expected, "json", limits); err != nil {
+				t.Fatalf("%v: %v", seq, err)
+			}
+			if err := Eval(NewStore(), fmt.Sprintf(test, list), got, "json", limits); err != nil {
+				t.Fatalf("%v: %v", test, err)
+			}
+
+			if expected.String() != got.String() {
+				t.Errorf("%v (%d workers): expected %v, got %v", test, w, expected, got)
+			}
+		}
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"log"
 	"regexp"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 // instructions
@@ -28,25 +31,38 @@ const (
 	opGTE
 	opEq
 	opNEq
-	opAnd
-	opOr
-	opLoad   // load a value from address addr (push a value on the stack)
-	opStore  // store a value from the top of the stack into a memory address
-	opObject // allocate a new object on the stack with that many fields
-	opSet    // set a field of an object to a value from the stack
-	opGet    // get a field of an object and push it on the stack
-	opIndex  // get an element of a list and push it on the stack
-	opLoop   // prepare for iteration over a list from the stack
-	opNext   // push the next element from the list on the stack and jump to op.Arg
-	opTest   // jump to op.Arg if the top of the stack is false
-	opMatch  // match a regular expression re with the top of the stack.
-	opCall   // call a function taking arguments from the stack and pushing the result back
-	opArg    // pass an integer value (op.Arg) to the next instruction (push)
+	opAnd      // jump to op.Arg leaving false on the stack if the value on the stack is false (pop it otherwise)
+	opOr       // jump to op.Arg leaving true on the stack if the value on the stack is true (pop it otherwise)
+	opLoad     // load a value from address addr (push a value on the stack)
+	opStore    // store a value from the top of the stack into a memory address
+	opObject   // allocate a new object on the stack with that many fields
+	opSet      // set a field of an object to a value from the stack
+	opGet      // get a field of an object and push it on the stack
+	opIndex    // get an element of a list and push it on the stack
+	opLoop     // prepare for iteration over a list from the stack (in parallel if the result address is not -1)
+	opNext     // push the next element from the list on the stack and jump to op.Arg
+	opTest     // jump to op.Arg if the top of the stack is false
+	opMatch    // match a regular expression re with the top of the stack.
+	opCall     // call a function taking arguments from the stack and pushing the result back
+	opArg      // pass an integer value (op.Arg) to the next instruction (push)
+	opBuckets  // allocate new hash buckets (op.Arg)
+	opBucket   // add a value from the stack to the bucket keyed by a value from the stack
+	opGroups   // push the buckets as a list of {key, elems} objects on the stack
+	opSort     // stable sort a list of [value, keys...] by keys (op.Arg has bits set for descending keys)
+	opSlice    // slice a list from the stack taking offset and limit from the stack
+	opLimit    // jump to op.Arg if the list on the stack has at least that many elements
+	opProbe    // push the bucket (elements) of hash buckets (op.Arg) keyed by a value from the stack
+	opJump     // jump to op.Arg
+	opIs       // push true if the value on the stack is of the kind (op.Arg)
+	opCoalesce // jump to op.Arg if the value on the stack is not null (pop it otherwise)
+	opEmit     // write a value from the stack to the output (as an element of the result)
+	opBool     // convert the value on the stack to a boolean
 )
 
 type Op struct {
 	Code int8
 	Arg  int
+	Name string /* of the expression for runtime errors */
 }
 
 type Program struct {
@@ -55,21 +71,170 @@ type Program struct {
 	regexps []*regexp.Regexp
 	funcs   []*Func
 	loops   []*iterator
+	groups  []*buckets
+	out     *emitter
+	halt    *int32 /* stops the program when set to non zero */
+	limits  Limits
 }
 
+// Limits of the resources used by a running program.
+type Limits struct {
+	Stack   int /* values on the stack */
+	Workers int /* goroutines of each parallel iteration (not shared by nested ones) */
+}
+
+// RuntimeError is a failure of a running program in the expression (Expr)
+// such as a division by zero.
+type RuntimeError struct {
+	Expr    string
+	Message string
+}
+
+// Stack grows on demand up to max values.
 type Stack struct {
-	data [4096]Value
+	data []Value
 	top  int
+	max  int
+}
+
+// DefaultLimits returns the limits of the programs unless set otherwise.
+func DefaultLimits() Limits {
+	return Limits{1 << 20, runtime.NumCPU()}
+}
+
+// part is the result of a worker of a parallel iteration (see opLoop).
+type part struct {
+	val  Value
+	fail interface{} /* the panic of the worker (e.g. *RuntimeError) */
 }
 
 type iterator struct {
 	pos  int
 	step int
 	list List
+	body *Body
+}
+
+// emitter writes the elements of the result list to the output as soon as
+// they are computed (see opEmit).
+type emitter struct {
+	w   Writer
+	err error
+}
+
+func (e *emitter) emit(v Value) {
+	if e.err == nil {
+		e.err = e.w.Write(v)
+	}
+}
+
+// buckets group values by the hash key of another value preserving the
+// order in which the keys were first seen.
+type buckets struct {
+	index map[string]int
+	keys  List
+	elems []List
+	all   List /* the values in the order they were added */
+	kinds int  /* the kinds of the keys (see keyKind) */
+}
+
+// byKeys sorts a list of [value, keys...] lists.
+type byKeys struct {
+	list List
+	desc int
+}
+
+func (b byKeys) Len() int {
+	return len(b.list)
+}
+
+func (b byKeys) Swap(i, j int) {
+	b.list[i], b.list[j] = b.list[j], b.list[i]
+}
+
+func (b byKeys) Less(i, j int) bool {
+	l := b.list[i].List()
+	r := b.list[j].List()
+	for k := 1; k < len(l); k++ {
+		c := compare(l[k], r[k])
+		if b.desc&(1<<uint(k-1)) != 0 {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+	}
+
+	return false
+}
+
+func newBuckets() *buckets {
+	return &buckets{index: make(map[string]int)}
+}
+
+func (b *buckets) add(key, elem Value) {
+	hash := hashKey(key)
+	pos, ok := b.index[hash]
+	if !ok {
+		pos = len(b.keys)
+		b.index[hash] = pos
+		b.keys = append(b.keys, key)
+		b.elems = append(b.elems, nil)
+	}
+
+	b.elems[pos] = append(b.elems[pos], elem)
+	b.all = append(b.all, elem)
+	b.kinds |= keyKind(key)
+}
+
+// find returns the values added with the keys equal to key, or all of them
+// (to be compared one by one) if their keys cannot be matched by hashes.
+func (b *buckets) find(key Value) List {
+	if !keyed(b.kinds | keyKind(key)) {
+		return b.all
+	}
+
+	pos, ok := b.index[hashKey(key)]
+	if !ok {
+		return nil
+	}
+
+	return b.elems[pos]
 }
 
-func (p *Program) Run(s *Stack) Value {
+func (b *buckets) groups() List {
+	res := make(List, len(b.keys))
+	for i, k := range b.keys {
+		res[i] = Object{k, b.elems[i]}
+	}
+
+	return res
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Expr == "" {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%v in '%v'", e.Message, e.Expr)
+}
+
+func raise(name, msg string, args ...interface{}) {
+	panic(&RuntimeError{name, fmt.Sprintf(msg, args...)})
+}
+
+// Run executes the program and returns the value from the top of the stack
+// (nil if the program was halted). The failures of the program (including
+// the ones of its parallel parts) are returned as *RuntimeError.
+func (p *Program) Run(s *Stack) (res Value, err error) {
 	i := 0
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, p.failure(r, i)
+		}
+	}()
+
 	for i > -1 && i < len(p.code) {
 		op := p.code[i]
 		jump := false
@@ -85,17 +250,29 @@ func (p *Program) Run(s *Stack) Value {
 		case opNot:
 			s.PushBool(!s.PopBool())
 		case opNeg:
+			if s.nulls(1) {
+				break
+			}
 			s.PushNum(-s.PopNum())
 		case opPos:
+			if s.nulls(1) {
+				break
+			}
 			s.PushNum(+s.PopNum())
 		case opAnd:
-			l := s.PopBool()
-			r := s.PopBool()
-			s.PushBool(l && r)
+			if !s.PopBool() {
+				s.PushBool(false)
+				i += op.Arg
+				jump = true
+			}
 		case opOr:
-			l := s.PopBool()
-			r := s.PopBool()
-			s.PushBool(l || r)
+			if s.PopBool() {
+				s.PushBool(true)
+				i += op.Arg
+				jump = true
+			}
+		case opBool:
+			s.PushBool(s.PopBool())
 		case opLT:
 			l := s.PopNum()
 			r := s.PopNum()
@@ -113,33 +290,51 @@ func (p *Program) Run(s *Stack) Value {
 			r := s.PopNum()
 			s.PushBool(l >= r)
 		case opAdd:
+			if s.nulls(2) {
+				break
+			}
 			l := s.PopNum()
 			r := s.PopNum()
 			s.PushNum(l + r)
 		case opSub:
+			if s.nulls(2) {
+				break
+			}
 			l := s.PopNum()
 			r := s.PopNum()
 			s.PushNum(l - r)
 		case opMul:
+			if s.nulls(2) {
+				break
+			}
 			l := s.PopNum()
 			r := s.PopNum()
 			s.PushNum(l * r)
 		case opDiv:
+			if s.nulls(2) {
+				break
+			}
 			l := s.PopNum()
 			r := s.PopNum()
+			if r == 0 {
+				raise(op.Name, "division by zero")
+			}
 			s.PushNum(l / r)
 		case opCat:
+			if s.nulls(2) {
+				break
+			}
 			l := s.PopStr()
 			r := s.PopStr()
 			s.PushStr(l + r)
 		case opEq:
 			l := s.Pop()
 			r := s.Pop()
-			s.Push(l.Equals(r))
+			s.Push(equals(l, r))
 		case opNEq:
 			l := s.Pop()
 			r := s.Pop()
-			s.PushBool(!bool(l.Equals(r)))
+			s.PushBool(!bool(equals(l, r)))
 		case opLoad:
 			s.Push(p.data[op.Arg])
 		case opStore:
@@ -152,72 +347,78 @@ func (p *Program) Run(s *Stack) Value {
 			obj[op.Arg] = val
 			s.PushObj(obj)
 		case opGet:
-			obj := s.PopObj()
-			val := obj[op.Arg]
-			s.Push(val)
+			val := s.Pop()
+			obj, isObject := val.(Object)
+			if isObject && op.Arg > -1 && op.Arg < len(obj) {
+				if line, isLine := obj[op.Arg].(Line); isLine {
+					s.Push(line.Value) /* a plain value outside of the row */
+				} else {
+					s.Push(obj[op.Arg])
+				}
+			} else if isNull(val) {
+				s.Push(Nil)
+			} else {
+				raise(op.Name, "cannot get a field of a %v", kindOf(val))
+			}
 		case opIndex:
 			list := s.PopList()
 			if op.Arg > -1 && op.Arg < len(list) {
 				s.Push(list[op.Arg])
 			} else {
-				s.Push(String(""))
+				s.Push(Nil)
 			}
 		case opArg:
 			s.Push(Number(op.Arg))
 		case opLoop:
-			parallel := s.PopBool()
+			res := int(s.PopNum())
 			offset := int(s.PopNum())
-			list := s.PopList()
 			lid := op.Arg
 
-			if len(list) > 0 {
-				if parallel {
-					cores := runtime.NumCPU()
-					if cores > len(list) {
-						cores = len(list)
-					}
-
-					ch := make(chan Value)
-					for c := 0; c < cores; c++ {
-						pc := p.Clone(i+1, i+1+offset)
-						pc.loops[lid] = &iterator{cores + c, cores, list}
-
-						sc := s.Clone()
-						sc.Push(list[c])
-
-						go func(_p *Program, _s *Stack) {
-							ch <- _p.Run(_s)
-						}(pc, sc)
-					}
-
-					var res List
-					for c := 0; c < cores; c++ {
-						part := <-ch
-						if part == nil {
-							continue
-						}
-
-						for _, v := range part.List() {
-							res = append(res, v)
-						}
-					}
-
-					s.PushList(res)
-
-					i += offset + 1
-					jump = true
+			if body, isBody := s.Peek().(*Body); isBody && res < 0 {
+				s.Pop()
+				if val, ok := body.Next(); ok {
+					p.loops[lid] = &iterator{0, 0, nil, body}
+					s.Push(val)
 				} else {
-					p.loops[lid] = &iterator{1, 1, list}
-					s.Push(list[0])
+					i += offset
+					jump = true
 				}
+
+				break
+			}
+
+			list := s.PopList()
+			workers := p.limits.Workers
+			if workers > len(list) {
+				workers = len(list)
+			}
+
+			if len(list) == 0 {
+				i += offset
+				jump = true
+			} else if res < 0 || workers < 2 {
+				p.loops[lid] = &iterator{1, 1, list, nil}
+				s.Push(list[0])
 			} else {
+				p.data[res] = p.parallel(i, offset, lid, res, list, workers, s.max)
 				i += offset
 				jump = true
 			}
 		case opNext:
+			if p.halt != nil && atomic.LoadInt32(p.halt) != 0 {
+				return nil, nil
+			}
+
 			offset := int(s.PopNum())
 			loop := p.loops[op.Arg]
-			if loop.pos > -1 && loop.pos < len(loop.list) {
+			if loop.body != nil {
+				if val, ok := loop.body.Next(); ok {
+					s.Push(val)
+
+					i += offset
+					jump = true
+				}
+			} else if loop.pos > -1 && loop.pos < len(loop.list) {
 				s.Push(loop.list[loop.pos])
 				loop.pos += loop.step
 
@@ -229,15 +430,67 @@ func (p *Program) Run(s *Stack) Value {
 				i += op.Arg
 				jump = true
 			}
+		case opJump:
+			i += op.Arg
+			jump = true
+		case opEmit:
+			p.out.emit(s.Pop())
+		case opIs:
+			s.PushBool(kindOf(s.Pop()) == kinds[op.Arg])
+		case opCoalesce:
+			val := s.Pop()
+			if isNull(val) {
+				break
+			}
+
+			s.Push(val)
+			i += op.Arg
+			jump = true
 		case opMatch:
 			str := s.PopStr()
 			val := p.regexps[op.Arg].MatchString(str)
 			s.PushBool(val)
 		case opCall:
 			p.funcs[op.Arg].Eval(s)
+		case opBuckets:
+			p.groups[op.Arg] = newBuckets()
+		case opBucket:
+			elem := s.Pop()
+			key := s.Pop()
+			p.groups[op.Arg].add(key, elem)
+		case opGroups:
+			s.PushList(p.groups[op.Arg].groups())
+			p.groups[op.Arg] = nil
+		case opSort:
+			list := s.PopList()
+			sort.Stable(byKeys{list, op.Arg})
+			for i, v := range list {
+				list[i] = v.List()[0]
+			}
+			s.PushList(list)
+		case opSlice:
+			limit := int(s.PopNum())
+			offset := int(s.PopNum())
+			list := s.PopList()
+			if offset > len(list) {
+				offset = len(list)
+			}
+			if limit > -1 && offset+limit < len(list) {
+				list = list[:offset+limit]
+			}
+			s.PushList(list[offset:])
+		case opProbe:
+			key := s.Pop()
+			s.PushList(p.groups[op.Arg].find(key))
+		case opLimit:
+			limit := int(s.PopNum())
+			list := s.PopList()
+			if len(list) >= limit {
+				i += op.Arg
+				jump = true
+			}
 		default:
-			msg := fmt.Sprintf("unknown operation %v", op)
-			panic(msg)
+			raise(op.Name, "unknown operation %v", op)
 		}
 
 		if !jump {
@@ -245,7 +498,22 @@ func (p *Program) Run(s *Stack) Value {
 		}
 	}
 
-	return s.Pop()
+	return s.Pop(), nil
+}
+
+// failure returns the runtime error raised by the instruction at pc. Other
+// panics (e.g. bugs in the functions) are not recovered.
+func (p *Program) failure(r interface{}, pc int) error {
+	e, ok := r.(*RuntimeError)
+	if !ok {
+		panic(r)
+	}
+
+	if e.Expr == "" && pc > -1 && pc < len(p.code) {
+		e.Expr = p.code[pc].Name
+	}
+
+	return e
 }
 
 func (p *Program) log() {
@@ -255,6 +523,106 @@ func (p *Program) log() {
 	}
 }
 
+// collect turns the streams (e.g. rows of a CSV file) into lists unless a
+// stream is iterated over only once by a sequential loop which is not nested
+// in any other loop.
+func (p *Program) collect() {
+	loads := make(map[int][]int)
+	for pc, op := range p.code {
+		if op.Code == opLoad {
+			loads[op.Arg] = append(loads[op.Arg], pc)
+		}
+	}
+
+	for addr, v := range p.data {
+		body, isBody := v.(*Body)
+		if !isBody {
+			continue
+		}
+
+		if len(loads[addr]) != 1 || !p.streams(loads[addr][0]) {
+			p.data[addr] = body.List()
+		}
+	}
+}
+
+// release stops the loaders of the streams iterated over by the program
+// (which may have been left before their end, e.g. by limit).
+func (p *Program) release() {
+	for _, v := range p.data {
+		if body, isBody := v.(*Body); isBody {
+			body.Close()
+		}
+	}
+}
+
+// streams checks if the value loaded at pc is the list of a sequential loop
+// (load, arg, arg, loop) which is not nested in any other loop.
+func (p *Program) streams(pc int) bool {
+	code := p.code
+	if pc+3 >= len(code) || code[pc+1].Code != opArg || code[pc+2].Code != opArg ||
+		code[pc+2].Arg != -1 || code[pc+3].Code != opLoop {
+		return false
+	}
+
+	for i, op := range code {
+		if op.Code == opLoop && i > 1 && i < pc && pc < i+code[i-2].Arg {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parallel splits the list into chunks iterated over by the loop (at pc) in
+// separate workers. The results of the workers are appended to the result of
+// the loop (at res) in the order of the chunks.
+func (p *Program) parallel(pc, offset, lid, res int, list List, workers, max int) List {
+	parts := make([]part, workers)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		chunk := list[w*len(list)/workers : (w+1)*len(list)/workers]
+
+		wp := p.Clone(pc+1, pc+offset)
+		wp.data[res] = make(List, 0)
+		wp.loops[lid] = &iterator{1, 1, chunk, nil}
+
+		ws := NewStack(max)
+		ws.Push(Nil) /* returned by Run, the result is in wp.data[res] */
+		ws.Push(chunk[0])
+
+		wg.Add(1)
+		go func(w int, wp *Program, ws *Stack) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					parts[w] = part{nil, r}
+				}
+			}()
+
+			if _, err := wp.Run(ws); err != nil {
+				parts[w] = part{nil, err}
+			} else {
+				parts[w] = part{wp.data[res], nil}
+			}
+		}(w, wp, ws)
+	}
+	wg.Wait()
+
+	result := p.data[res].List()
+	for _, part := range parts {
+		if part.fail != nil {
+			panic(part.fail)
+		}
+
+		for _, v := range part.val.List() {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
 func (p *Program) Clone(from, to int) *Program {
 	// TODO: deep copy
 	res := new(Program)
@@ -263,25 +631,33 @@ func (p *Program) Clone(from, to int) *Program {
 	res.regexps = make([]*regexp.Regexp, len(p.regexps))
 	res.funcs = make([]*Func, len(p.funcs))
 	res.loops = make([]*iterator, len(p.loops))
+	res.groups = make([]*buckets, len(p.groups))
 
 	copy(res.data, p.data)
 	for i, re := range p.regexps {
 		res.regexps[i] = regexp.MustCompile(re.String())
 	}
 	copy(res.funcs, p.funcs)
+	for i, it := range p.loops {
+		if it != nil {
+			cp := *it
+			res.loops[i] = &cp
+		}
+	}
+	copy(res.groups, p.groups) /* hash tables of joins are read only */
+	res.halt = p.halt
+	res.limits = p.limits
 
 	return res
 }
 
-func (s *Stack) Clone() *Stack {
-	res := new(Stack)
-	for i := 0; i < s.top; i++ {
-		// TODO: deep copy
-		res.data[i] = s.data[i]
+func NewStack(max int) *Stack {
+	size := 64
+	if size > max {
+		size = max
 	}
-	res.top = s.top
 
-	return res
+	return &Stack{make([]Value, size), 0, max}
 }
 
 func (op Op) String() string {
@@ -319,9 +695,9 @@ func (op Op) String() string {
 	case opNEq:
 		return "neq"
 	case opAnd:
-		return "and"
+		return fmt.Sprintf("and %d", op.Arg)
 	case opOr:
-		return "or"
+		return fmt.Sprintf("or %d", op.Arg)
 	case opLoad:
 		return fmt.Sprintf("load %d", op.Arg)
 	case opStore:
@@ -346,142 +722,254 @@ func (op Op) String() string {
 		return fmt.Sprintf("call %d", op.Arg)
 	case opArg:
 		return fmt.Sprintf("arg %d", op.Arg)
+	case opBuckets:
+		return fmt.Sprintf("buckets %d", op.Arg)
+	case opBucket:
+		return fmt.Sprintf("bucket %d", op.Arg)
+	case opGroups:
+		return fmt.Sprintf("groups %d", op.Arg)
+	case opSort:
+		return fmt.Sprintf("sort %d", op.Arg)
+	case opSlice:
+		return "slice"
+	case opLimit:
+		return fmt.Sprintf("limit %d", op.Arg)
+	case opProbe:
+		return fmt.Sprintf("probe %d", op.Arg)
+	case opJump:
+		return fmt.Sprintf("jump %d", op.Arg)
+	case opIs:
+		return fmt.Sprintf("is %d", op.Arg)
+	case opEmit:
+		return "emit"
+	case opCoalesce:
+		return fmt.Sprintf("coalesce %d", op.Arg)
+	case opBool:
+		return "bool"
 	}
 
 	return fmt.Sprintf("unknown op=%d arg=%d", op.Code, op.Arg)
 }
 
 func OpList() Op {
-	return Op{opList, 0}
+	return Op{opList, 0, ""}
 }
 
 func OpAppend() Op {
-	return Op{opAppend, 0}
+	return Op{opAppend, 0, ""}
 }
 
 func OpNot() Op {
-	return Op{opNot, 0}
+	return Op{opNot, 0, ""}
 }
 
 func OpNeg() Op {
-	return Op{opNeg, 0}
+	return Op{opNeg, 0, ""}
 }
 
 func OpPos() Op {
-	return Op{opPos, 0}
+	return Op{opPos, 0, ""}
 }
 
 func OpMul() Op {
-	return Op{opMul, 0}
+	return Op{opMul, 0, ""}
 }
 
 func OpDiv() Op {
-	return Op{opDiv, 0}
+	return Op{opDiv, 0, ""}
 }
 
 func OpAdd() Op {
-	return Op{opAdd, 0}
+	return Op{opAdd, 0, ""}
 }
 
 func OpSub() Op {
-	return Op{opSub, 0}
+	return Op{opSub, 0, ""}
 }
 
 func OpCat() Op {
-	return Op{opCat, 0}
+	return Op{opCat, 0, ""}
 }
 
 func OpLT() Op {
-	return Op{opLT, 0}
+	return Op{opLT, 0, ""}
 }
 
 func OpLTE() Op {
-	return Op{opLTE, 0}
+	return Op{opLTE, 0, ""}
 }
 
 func OpGT() Op {
-	return Op{opGT, 0}
+	return Op{opGT, 0, ""}
 }
 
 func OpGTE() Op {
-	return Op{opGTE, 0}
+	return Op{opGTE, 0, ""}
 }
 
 func OpEq() Op {
-	return Op{opEq, 0}
+	return Op{opEq, 0, ""}
 }
 
 func OpNEq() Op {
-	return Op{opNEq, 0}
+	return Op{opNEq, 0, ""}
 }
 
-func OpAnd() Op {
-	return Op{opAnd, 0}
+func OpAnd(jump int) Op {
+	return Op{opAnd, jump, ""}
 }
 
-func OpOr() Op {
-	return Op{opOr, 0}
+func OpOr(jump int) Op {
+	return Op{opOr, jump, ""}
 }
 
 func OpLoad(addr int) Op {
-	return Op{opLoad, addr}
+	return Op{opLoad, addr, ""}
 }
 
 func OpStore(addr int) Op {
-	return Op{opStore, addr}
+	return Op{opStore, addr, ""}
 }
 
 func OpObject(fields int) Op {
-	return Op{opObject, fields}
+	return Op{opObject, fields, ""}
 }
 
 func OpSet(field int) Op {
-	return Op{opSet, field}
+	return Op{opSet, field, ""}
 }
 
 func OpGet(field int) Op {
-	return Op{opGet, field}
+	return Op{opGet, field, ""}
 }
 
 func OpIndex(field int) Op {
-	return Op{opIndex, field}
+	return Op{opIndex, field, ""}
 }
 
 func OpLoop(lid int) Op {
-	return Op{opLoop, lid}
+	return Op{opLoop, lid, ""}
 }
 
 func OpNext(lid int) Op {
-	return Op{opNext, lid}
+	return Op{opNext, lid, ""}
 }
 
 func OpTest(jump int) Op {
-	return Op{opTest, jump}
+	return Op{opTest, jump, ""}
 }
 
 func OpCall(fn int) Op {
-	return Op{opCall, fn}
+	return Op{opCall, fn, ""}
 }
 
 func OpMatch(re int) Op {
-	return Op{opMatch, re}
+	return Op{opMatch, re, ""}
 }
 
 func OpArg(arg int) Op {
-	return Op{opArg, arg}
+	return Op{opArg, arg, ""}
+}
+
+func OpBuckets(gid int) Op {
+	return Op{opBuckets, gid, ""}
+}
+
+func OpBucket(gid int) Op {
+	return Op{opBucket, gid, ""}
+}
+
+func OpGroups(gid int) Op {
+	return Op{opGroups, gid, ""}
+}
+
+func OpSort(desc int) Op {
+	return Op{opSort, desc, ""}
+}
+
+func OpSlice() Op {
+	return Op{opSlice, 0, ""}
+}
+
+func OpLimit(jump int) Op {
+	return Op{opLimit, jump, ""}
+}
+
+func OpProbe(gid int) Op {
+	return Op{opProbe, gid, ""}
+}
+
+func OpJump(jump int) Op {
+	return Op{opJump, jump, ""}
+}
+
+func OpEmit() Op {
+	return Op{opEmit, 0, ""}
+}
+
+func OpIs(kind int) Op {
+	return Op{opIs, kind, ""}
+}
+
+func OpCoalesce(jump int) Op {
+	return Op{opCoalesce, jump, ""}
+}
+
+func OpBool() Op {
+	return Op{opBool, 0, ""}
 }
 
 func (s *Stack) Push(v Value) {
+	s.check()
 	s.data[s.top] = v
 	s.top++
 }
 
+// check makes room for a value on the stack doubling its size if needed.
+func (s *Stack) check() {
+	if s.top < len(s.data) {
+		return
+	}
+
+	if s.top >= s.max {
+		raise("", "stack overflow (more than %d values)", s.max)
+	}
+
+	size := 2 * len(s.data)
+	if size > s.max {
+		size = s.max
+	}
+
+	data := make([]Value, size)
+	copy(data, s.data[:s.top])
+	s.data = data
+}
+
 func (s *Stack) Pop() Value {
 	s.top--
 	return s.data[s.top]
 }
 
+// nulls replaces n values on the top of the stack with a single null if any
+// of them is null (and tells whether it did).
+func (s *Stack) nulls(n int) bool {
+	for i := s.top - n; i < s.top; i++ {
+		if isNull(s.data[i]) {
+			s.top -= n
+			s.Push(Nil)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Stack) Peek() Value {
+	return s.data[s.top-1]
+}
+
 func (s *Stack) PushBool(b bool) {
+	s.check()
 	s.data[s.top] = Bool(b)
 	s.top++
 }
@@ -492,6 +980,7 @@ func (s *Stack) PopBool() bool {
 }
 
 func (s *Stack) PushNum(n float64) {
+	s.check()
 	s.data[s.top] = Number(n)
 	s.top++
 }
@@ -502,6 +991,7 @@ func (s *Stack) PopNum() float64 {
 }
 
 func (s *Stack) PushStr(str string) {
+	s.check()
 	s.data[s.top] = String(str)
 	s.top++
 }
@@ -512,6 +1002,7 @@ func (s *Stack) PopStr() string {
 }
 
 func (s *Stack) PushList(l List) {
+	s.check()
 	s.data[s.top] = l
 	s.top++
 }
@@ -526,6 +1017,7 @@ func (s *Stack) PopList() List {
 }
 
 func (s *Stack) PushObj(o Object) {
+	s.check()
 	s.data[s.top] = o
 	s.top++
 }
@@ -4,19 +4,26 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 const usage = `comp [-f <files>] <expr>
+comp -f <files> (interactive mode)
+comp -f <files> -serve <addr> (query server)
 
 examples
   cat file.json | comp -f @json '[ i | i <- in, i.name =~ \"hello\" ]'
   comp -f file1.json,file2.csv '[ {i, j} | i <- file1, j <- file2, i.id == j.id ]'
+  comp -f file.csv -o table '[ {r.id, r.name} | r <- file ]'
+  comp -f file.csv -serve :8080 (then curl -d 'count(file)' localhost:8080)
 
 flags
 `
@@ -41,30 +48,107 @@ func openFiles(files string) (map[string]io.Reader, error) {
 	return res, nil
 }
 
-func Run(expr string, inputs map[string]io.Reader, output io.Writer) error {
-	store := Store{make(map[string]Type), make(map[string]Value)}
+// Load reads the inputs into a new store.
+func Load(inputs map[string]io.Reader) (Store, error) {
+	store := NewStore()
 	for k, v := range inputs {
 		if err := store.Add(k, v); err != nil {
-			return err
+			return store, err
 		}
 	}
 
-	decls := store.Decls()
+	return store, nil
+}
+
+func Run(expr string, inputs map[string]io.Reader, output io.Writer, format string) error {
+	store, err := Load(inputs)
+	if err != nil {
+		return err
+	}
 
+	return Eval(store, expr, output, format, DefaultLimits())
+}
+
+// Eval compiles and runs the expression against the values of the store.
+func Eval(store Store, expr string, output io.Writer, format string, limits Limits) error {
+	decls := store.Decls()
 	prg, rt, err := Compile(expr, decls)
 	if err != nil {
 		return err
 	}
+	prg.limits = limits
+
+	return Exec(prg, rt, output, format)
+}
 
-	res := prg.Run(new(Stack))
-	if res != nil {
-		if err := res.Quote(output, rt); err != nil {
+// Exec runs the program and writes its result (of type rt) to the output.
+func Exec(prg *Program, rt Type, output io.Writer, format string) error {
+	defer prg.release()
+
+	w, err := NewWriter(format, output, rt)
+	if err != nil {
+		return err
+	}
+
+	if prg.out != nil { /* results are written while the program runs */
+		prg.out.w = w
+		if _, err := prg.Run(NewStack(prg.limits.Stack)); err != nil {
+			return err
+		}
+		if prg.out.err != nil {
+			return prg.out.err
+		}
+	} else {
+		res, err := prg.Run(NewStack(prg.limits.Stack))
+		if err != nil {
+			return err
+		} else if res == nil {
+			return nil
+		}
+
+		if _, isList := rt.(ListType); isList {
+			for _, v := range res.List() {
+				if err := w.Write(v); err != nil {
+					return err
+				}
+			}
+		} else if err := w.Write(res); err != nil {
 			return err
 		}
-		fmt.Printf("\n")
 	}
 
-	return nil
+	return w.Close()
+}
+
+// exit codes
+const (
+	exitLoad    = iota + 1 // an input cannot be opened or read
+	exitCompile            // the expression does not parse or type check
+	exitRuntime            // the query fails while running or writing the result
+	exitUsage              // invalid command line arguments
+)
+
+// asParseError wraps the errors other than *ParseError (without a position).
+func asParseError(err error) *ParseError {
+	if pe, ok := err.(*ParseError); ok {
+		return pe
+	}
+
+	return NewError(0, 0, "%v", err)
+}
+
+// exit reports the error of the expression (as a JSON object with -errors
+// json) and exits with the code.
+func exit(code int, err error, expr, errors string) {
+	if errors == "json" {
+		json.NewEncoder(os.Stderr).Encode(asParseError(err))
+	} else if _, ok := err.(*ParseError); ok {
+		report(os.Stderr, expr, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	os.Exit(code)
 }
 
 func main() {
@@ -73,22 +157,75 @@ func main() {
 		flag.PrintDefaults()
 	}
 
-	files := flag.String("f", "", "comma separated list of files (@json @csv @txt @xml for stdin types)")
+	files := flag.String("f", "", "comma separated list of files (@json @jsonl @csv @txt @xml for stdin types)")
+	format := flag.String("o", "json", "output format (json, jsonl, csv, tsv, table)")
+	errors := flag.String("errors", "text", "error format (text, json)")
+	serve := flag.String("serve", "", "serve queries via HTTP POST on the address (e.g. :8080)")
+	timeout := flag.Duration("timeout", 30*time.Second, "time limit of a query in the server mode")
+	limit := flag.Int("limit", 64*1024*1024, "size limit of a query result (in bytes) in the server mode")
+	limits := DefaultLimits()
+	flag.IntVar(&limits.Stack, "stack", limits.Stack, "size limit of the stack (in values)")
+	flag.IntVar(&limits.Workers, "j", limits.Workers, "number of workers of each parallel iteration (<~), nested ones multiply")
 	flag.Parse()
 
 	args := flag.Args()
-	if len(args) != 1 {
+	interactive := len(args) == 0 && *files != "" && *serve == ""
+	if *serve != "" && len(args) != 0 {
 		flag.Usage()
-		return
+		os.Exit(exitUsage)
+	} else if len(args) != 1 && !interactive && *serve == "" {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *errors != "text" && *errors != "json" {
+		exit(exitUsage, fmt.Errorf("unknown error format %v (use one of text, json)", *errors), "", "text")
+	}
+	if err := checkFormat(*format); err != nil {
+		exit(exitUsage, err, "", *errors)
+	}
+	if limits.Stack < 1 {
+		exit(exitUsage, fmt.Errorf("invalid stack size %v (must be at least 1)", limits.Stack), "", *errors)
+	}
+	if limits.Workers < 1 {
+		exit(exitUsage, fmt.Errorf("invalid number of workers %v (must be at least 1)", limits.Workers), "", *errors)
+	}
+	if interactive && strings.Contains(*files, "@") {
+		exit(exitUsage, fmt.Errorf("stdin cannot be used as an input in the interactive mode"), "", *errors)
 	}
 
 	inputs, err := openFiles(*files)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(exitLoad, err, "", *errors)
 	}
 
-	if err := Run(args[0], inputs, os.Stdout); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+	store, err := Load(inputs)
+	if err != nil {
+		exit(exitLoad, err, "", *errors)
+	}
+
+	if *serve != "" {
+		log.Fatal(Serve(*serve, NewServer(store, *timeout, *limit, limits)))
+	}
+
+	if interactive {
+		Repl(store, os.Stdin, os.Stdout, *format, limits)
+		return
+	}
+
+	// The buffered output of a failed query is dropped (a long result may be
+	// partially written already, the exit status tells it is incomplete).
+	output := bufio.NewWriter(os.Stdout)
+	if err := Eval(store, args[0], output, *format, limits); err != nil {
+		if _, isParse := err.(*ParseError); isParse {
+			exit(exitCompile, err, args[0], *errors)
+		}
+
+		exit(exitRuntime, err, args[0], *errors)
+	}
+
+	if err := output.Flush(); err != nil {
+		exit(exitRuntime, err, "", *errors)
 	}
 }
 
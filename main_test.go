@@ -7,7 +7,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"strings"
+	"syscall"
+	"testing"
 )
 
 func ExampleBools() {
@@ -316,11 +321,11 @@ func ExampleLists() {
 	// [1,2,3]
 	// ["a","b","c"]
 	// "a"
-	// ""
+	// null
 	// "b"
 	// {"id":1}
-	// [{"a":"a"},{"a":"b"},{"a":"c"}]
-	// [{"\"a\"":"a"},{"\"a\"":"b"},{"\"a\"":"c"}]
+	// '{a}' and '{"b"}' cannot be elements of the same list
+	// '{"a"}' and '{"b"}' cannot be elements of the same list
 }
 
 func ExampleObjects() {
@@ -354,6 +359,23 @@ func ExampleObjects() {
 	// "hello"
 }
 
+func ExampleKeywords() {
+	run("{desc: 1, in: 2, if: 3, null: 4}")
+	run("[x.desc | x <- [{desc: 1}]]")
+	run("[by | by <- [1, 2]]")
+	run("[limit | limit <- [3, 1, 2], limit > 1, order by limit desc, limit 1]")
+	run("[{k: by, n: count(into)} | i <- [1, 2, 2], group i by by = i into into]")
+	run("let desc = 1 in desc + 1")
+
+	// Output:
+	// {"desc":1,"in":2,"if":3,"null":4}
+	// [1]
+	// [1,2]
+	// [3]
+	// [{"k":1,"n":1},{"k":2,"n":2}]
+	// 2
+}
+
 func ExampleComps() {
 	run("[i | i <- [1, 2, 3]]")
 	run("[i | i <- [1, 2, 3], i != 2]")
@@ -365,8 +387,8 @@ func ExampleComps() {
 	run("[i * j | i <- [1, 2, 3], j <- [10, 20]]")
 	run("[i * j | i <- [1, 2, 3], j <- [10, 20], i == j / 10]")
 	run("[i * j | i <- [1, 2, 3], trunc(i), j <- [10, 20]]")
-	run(`[ i["a"] | i <- [{a: "a"}, {"b"}, {"c"}]]`)
-	run(`[ i["\"a\""] | i <- [{"a"}, {"b"}, {"c"}]]`)
+	run(`[ i["a"] | i <- [{a: "a"}, {a: "b"}, {a: "c"}]]`)
+	run(`[ i["\"a\""] | i <- [{"a"}, {"a"}, {"a"}]]`)
 	run(`[{g,c}|g <- [1], c <- [0], c-1 == 0 && c == 0]`)
 	run(`[{g,c}|g <- [1], c <- [0], c-1 == 0, c == 0]`)
 
@@ -382,9 +404,266 @@ func ExampleComps() {
 	// [10,40]
 	// [10,20,20,40,30,60]
 	// ["a","b","c"]
-	// ["a","b","c"]
-	//
-	//
+	// ["a","a","a"]
+	// []
+	// []
+}
+
+func ExampleGroups() {
+	run("[{k, g} | i <- [1, 2, 3, 4, 5], group i by k = trunc(i / 2) into g]")
+	run("[{k, n: count(g)} | i <- [`a`, `b`, `a`], group i by k = i into g]")
+	run("[{k, s: sum(g)} | i <- [1, 2, 3, 4], i > 1, group i * 10 by k = i > 2 into g]")
+	run("[k | i <- [1, 2], j <- [1, 2], group {i, j} by k = i + j into g, count(g) > 1]")
+	run("[k | i <- [1, 2, 3], i > 3, group i by k = i into g]")
+	run("[{k, g} | i <- [{id: 1, v: `x`}, {id: 2, v: `y`}, {id: 1, v: `z`}], group i.v by k = i.id into g]")
+	run("[[k | i <- [1, 1, 2], group i by k = i into g] | j <- [1, 2]]")
+	run("[k | i <- [1, 2], group i by k = i into k]")
+	run("[k | i <~ [1, 2], group i by k = i into g]")
+	run("[k | i <- [1, 2], j <~ [1, 2], group {i, j} by k = i + j into g]")
+	run("[[k | i <- [1, 1, 2], group i by k = i into g] | j <~ [1, 2]]")
+	run("[{k, i} | i <- [1, 2, 3], group i by k = i > 1 into g]")
+	run("[k | i <- [1, 2, 3], j = i * 2, group i by k = i > 1 into g, j > 2]")
+	run("[k | i <- [1, 2, 3], group i by k = i > 1 into g, order by i]")
+	run("[h | i <- [1, 2, 3], group i by k = i > 1 into g, group k by h = i into f]")
+	run("[{k, n: count(g)} | i <- [1, 2, 3], group i by k = i > 1 into g, k]")
+
+	// Output:
+	// [{"k":0,"g":[1]},{"k":1,"g":[2,3]},{"k":2,"g":[4,5]}]
+	// [{"k":"a","n":2},{"k":"b","n":1}]
+	// [{"k":false,"s":20},{"k":true,"s":70}]
+	// [3]
+	// []
+	// [{"k":1,"g":["x","z"]},{"k":2,"g":["y"]}]
+	// [[1,2],[1,2]]
+	// 'k' is already declared
+	// group by cannot be used with parallel generators (<~)
+	// group by cannot be used with parallel generators (<~)
+	// [[1,2],[1,2]]
+	// 'i' is not available after group by
+	// 'j' is not available after group by
+	// 'i' is not available after group by
+	// 'i' is not available after group by
+	// [{"k":true,"n":2}]
+}
+
+func ExampleOrder() {
+	run("[i | i <- [3, 1, 2], order by i]")
+	run("[i | i <- [3, 1, 2], order by i asc]")
+	run("[i | i <- [3, 1, 2], order by i desc]")
+	run("[i | i <- [`b`, 10, `a`, `9`, true], order by i]")
+	run("[{i, j} | i <- [1, 2], j <- [`x`, `y`], order by j desc, order by i]")
+	run("[i | i <- [1, 2, 3, 4, 5], limit 2]")
+	run("[i | i <- [1, 2, 3, 4, 5], offset 3]")
+	run("[i | i <- [1, 2, 3, 4, 5], offset 1, limit 2]")
+	run("[i | i <- [1, 2, 3, 4, 5], i != 4, order by i desc, limit 3]")
+	run("[i * j | i <- [1, 2, 3], j <- [1, 10], limit 3]")
+	run("[i | i <- [1, 2, 3], limit 0]")
+	run("[i | i <- [1, 2, 3], offset 5]")
+	run("[[j | j <- [1, 2, 3], order by j desc, limit 1] | i <- [1, 2]]")
+	run("[k | i <- [1, 2, 3, 4, 5], group i by k = i > 3 into g, order by count(g), limit 1]")
+
+	// Output:
+	// [1,2,3]
+	// [1,2,3]
+	// [3,2,1]
+	// [true,"9",10,"a","b"]
+	// [{"i":1,"j":"y"},{"i":2,"j":"y"},{"i":1,"j":"x"},{"i":2,"j":"x"}]
+	// [1,2]
+	// [4,5]
+	// [2,3]
+	// [5,3,2]
+	// [1,10,2]
+	// []
+	// []
+	// [[3],[3]]
+	// [true]
+}
+
+func ExampleJoins() {
+	run("[{i, j} | i <- [1, 2, 3], j <- [3, 2, 1], i == j]")
+	run("[{i, j} | i <- [1, 2, 3], j <- [3, 2, 1], j == i]")
+	run("[{i, j} | i <- [1, `2`, 3], j <- [`1`, 2, `3.0`], i == j]")
+	run("[{a: i.a, b: j.b} | i <- [{id: 1, a: 1}, {id: 2, a: 2}], j <- [{id: 1, b: 1}, {id: 1, b: 2}], i.id == j.id]")
+	run("[{i, j, k} | i <- [1, 2], j <- [1, 2], k <- [2, 1], k == i, j == k]")
+	run("[{i, j} | i <- [1, 2], j <- [i, 3], i == j]")
+	run("[[{i, j} | i <- [1, 2], j <- [2, 3], i == j] | k <- [1, 2]]")
+	run("[{x, y} | x <- [0, 1, true], y <- [`abc`, `true`, `1`], x == y]")
+	runWithInputs("[{a: a.id, b: b.k} | a <- t, b <- t, a.id == b.k]", "t.csv", "id,k\n0,xyz\n1,1\n")
+
+	// Output:
+	// [{"i":1,"j":1},{"i":2,"j":2},{"i":3,"j":3}]
+	// [{"i":1,"j":1},{"i":2,"j":2},{"i":3,"j":3}]
+	// [{"i":1,"j":"1"},{"i":"2","j":2},{"i":3,"j":"3.0"}]
+	// [{"a":1,"b":1},{"a":1,"b":2}]
+	// [{"i":1,"j":1,"k":1},{"i":2,"j":2,"k":2}]
+	// [{"i":1,"j":1},{"i":2,"j":2}]
+	// [[{"i":2,"j":2}],[{"i":2,"j":2}]]
+	// [{"x":0,"y":"abc"},{"x":0,"y":"true"},{"x":1,"y":"1"},{"x":true,"y":"abc"},{"x":true,"y":"true"},{"x":true,"y":"1"}]
+	// [{"a":0,"b":"xyz"},{"a":1,"b":1}]
+}
+
+func ExampleLets() {
+	run("let x = 2 in x * x")
+	run("let x = 2 in let y = x + 1 in x * y")
+	run("let x = [1, 2, 3] in [i | i <- x, i > 1]")
+	run("[t | i <- [1, 2, 3, 4], d = i * 10, d > 10, t = {i, d}]")
+	run("[d | i <- [1, 2], j <- [3, 4], d = i * 10]")
+	run("[let y = i * 2 in y + 1 | i <- [1, 2]]")
+	run("[i | i <- [1, 2, 3], let y = i * 2 in y > 3]")
+	run("[i | i <- [1], i = 2]")
+	run("[i | i <- [1], d > 1, d = 2]")
+	run("(let x = 1 in x) + (let x = 2 in x)")
+	run("(let x = 1 in x) + x")
+	run("let x = (let y = 2 in y) in x + y")
+	run("let x = 1 in let x = 2 in x")
+
+	// Output:
+	// 4
+	// 6
+	// [2,3]
+	// [{"i":2,"d":20},{"i":3,"d":30},{"i":4,"d":40}]
+	// [10,10,20,20]
+	// [3,5]
+	// [2,3]
+	// 'i' is already declared
+	// unknown identifier 'd'
+	// 3
+	// unknown identifier 'x'
+	// unknown identifier 'y'
+	// 'x' is already declared
+}
+
+func ExampleConditionals() {
+	run("if 1 < 2 then `yes` else `no`")
+	run("if 1 > 2 then `yes` else `no`")
+	run("[if i > 1 then `big` else `small` | i <- [1, 2, 3]]")
+	run("[if i.qty > 0 then i.price / i.qty else 0 | i <- [{qty: 2, price: 5}, {qty: 0, price: 3}]]")
+	run("if true then if false then 1 else 2 else 3")
+	run("let x = 5 in if x > 3 then x * 2 else x")
+	run("if true then {a: 1} else {a: `one`}")
+	run("if true then 1 else [1]")
+	run("if true then {a: 1} else {b: 1}")
+
+	// Output:
+	// "yes"
+	// "no"
+	// ["small","big","big"]
+	// [2.5,0]
+	// 2
+	// 10
+	// {"a":1}
+	// '1' and '[1]' have different types
+	// '{a}' and '{b}' have different types
+}
+
+func ExampleNulls() {
+	run("null")
+	run("null + 1")
+	run("-null")
+	run("`a` ++ null")
+	run("null == null")
+	run("null == false")
+	run("null != ``")
+	run("null is null")
+	run("0 is null")
+	run("[1, null][1] is not null")
+	run("[1, 2][5]")
+	run("coalesce(null, null, 3)")
+	run("coalesce([1][7], 2)")
+	run("[coalesce(i.a, 0) | i <- [{a: 1}, {a: null}]]")
+	run("let x = [1, null, 3] in {s: sum(x), a: avg(x), lo: min(x), hi: max(x), n: count(x)}")
+	run("let x = [null] in {a: avg(x), lo: min(x), hi: max(x)}")
+	run("coalesce(1, [1])")
+
+	runWithInputs("[i.a | i <- in]", "in.json", `[{"a": null}, {"a": false}, {"a": 1}]`)
+	runWithInputs("[i | i <- in, i is null]", "in.json", `[null, [1], null]`)
+	runWithInputs("count([r | r <- t, r.b is null])", "t.csv", "a,b\n1,\n2,x\n3\n")
+
+	// Output:
+	// null
+	// null
+	// null
+	// null
+	// true
+	// false
+	// true
+	// true
+	// false
+	// false
+	// null
+	// 3
+	// 2
+	// [1,0]
+	// {"s":4,"a":2,"lo":1,"hi":3,"n":3}
+	// {"a":null,"lo":null,"hi":null}
+	// '1' and '[1]' have different types
+	// [null,false,1]
+	// [null,null]
+	// 2
+}
+
+func ExampleUnions() {
+	mixed := `[1, "a", {"x": 1}, [1, 2], null]`
+
+	runWithInputs("in", "in.json", mixed)
+	runWithInputs("[i is object | i <- in]", "in.json", mixed)
+	runWithInputs("[i.x | i <- in, i is object]", "in.json", mixed)
+	runWithInputs("[count(i) | i <- in, i is list]", "in.json", mixed)
+	runWithInputs("[i | i <- in, i is not list, i is not object]", "in.json", mixed)
+	runWithInputs("[if true then i else i | i <- in]", "in.json", mixed)
+	runWithInputs("[coalesce(i, i) | i <- in]", "in.json", mixed)
+	runWithInputs("[coalesce(i, 0) | i <- in]", "in.json", mixed)
+	runWithInputs("[if i is object then i else 0 | i <- in]", "in.json", mixed)
+	runWithInputs("[if i is object then i else {y: 1} | i <- in]", "in.json", mixed)
+	run("[1] is scalar")
+	run("1 is number")
+	run(`[1, "a", {x: 1}, [1, 2], null]`)
+	run(`[i.x | i <- [1, {x: 2}, {x: [3]}], i is object]`)
+	run(`[[1], [{x: 1}]]`)
+	run(`[{x: 1}, {x: 2, y: 3}]`)
+	run(`[{x: 1}, {y: 2}]`)
+	run(`[{a: 1, b: "s"}, {b: 3, a: 4}]`)
+	run(`[i.o.a | i <- [{o: {a: 1, b: 2}}, {o: {b: 3, a: 4}}]]`)
+	run(`[(if i then {a: 1, b: 2} else {b: 3, a: 4}).a | i <- [true, false]]`)
+	run(`coalesce(null, {b: 3, a: 4}, {a: 1, b: 2})`)
+	run(`[i.x | i <- [{x: 1}, {y: 2}]]`)
+	run(`[{a: 1, b: 2}, {a: "s", b: null}, {a: [1], b: {c: 3}}]`)
+
+	const xml = `
+		<orders>
+		    <order><line>1</line></order>
+		    <order><line>2</line><line>3</line></order>
+		</orders>`
+
+	runWithInputs(`[count(o.line) | o <- x.orders.order]`, "x.xml", xml)
+	runWithInputs(`[l["text()"] | o <- x.orders.order, l <- o.line]`, "x.xml", xml)
+
+	// Output:
+	// [1,"a",{"x":1},[1,2],null]
+	// [false,false,true,false,false]
+	// [1]
+	// [2]
+	// [1,"a",null]
+	// [1,"a",{"x":1},[1,2],null]
+	// [1,"a",{"x":1},[1,2],null]
+	// [1,"a",{"x":1},[1,2],0]
+	// [0,0,{"x":1},0,0]
+	// 'i' and '{y}' have different types
+	// false
+	// unknown kind 'number' (use one of null, scalar, list, object)
+	// [1,"a",{"x":1},[1,2],null]
+	// [2,[3]]
+	// [[1],[{"x":1}]]
+	// '{x}' and '{x, y}' cannot be elements of the same list
+	// '{x}' and '{y}' cannot be elements of the same list
+	// [{"a":1,"b":"s"},{"a":4,"b":3}]
+	// [1,4]
+	// [1,4]
+	// {"b":3,"a":4}
+	// '{x}' and '{y}' cannot be elements of the same list
+	// [{"a":1,"b":2},{"a":"s","b":null},{"a":[1],"b":{"c":3}}]
+	// [1,2]
+	// ["1","2","3"]
 }
 
 func ExampleFuncs() {
@@ -402,6 +681,95 @@ func ExampleFuncs() {
 	// "123456"
 }
 
+func ExampleAggregates() {
+	run("count([1, 2, 3])")
+	run("count([{id: 1}, {id: 2}])")
+	run("count([i | i <- [1, 2, 3], i > 1])")
+	run("sum([i * 2 | i <- [1, 2, 3]])")
+	run("sum([i.price | i <- [{price: 1.5}, {price: 2}]])")
+	run("avg([1, 2, 3, 4])")
+	run("min([3, 1, 2])")
+	run("max([3, 1, 2])")
+	run("[{i, n: count([j | j <- [1, 2, 3]])} | i <- [1, 2]]")
+	run("sum(1)")
+	run("sum([[1, 2]])")
+	run("min([`b`, `a`, `c`])")
+	run("max([`b`, `a`, `c`])")
+	run("min([`b`, 2, `10`])")
+	run("max([`b`, 2, `10`])")
+	run("sum([1, `2`, null])")
+	run("sum([1, `a`])")
+	run("avg([`x`])")
+	run("lower([1, 2])")
+	run("lower([`%d`])")
+	run("lower(coalesce(null, [`%v`]))")
+	run("count(1, 2)")
+
+	// Output:
+	// 3
+	// 2
+	// 2
+	// 12
+	// 3.5
+	// 2.5
+	// 1
+	// 3
+	// [{"i":1,"n":3},{"i":2,"n":3}]
+	// argument 1 of sum must be [scalar], '1' is scalar
+	// argument 1 of sum must be [scalar], '[[1, 2]]' is [[scalar]]
+	// "a"
+	// "c"
+	// 2
+	// "b"
+	// 3
+	// 'a' is not a number in 'sum([1, "a"])'
+	// 'x' is not a number in 'avg(["x"])'
+	// argument 1 of lower must be scalar, '[1, 2]' is [scalar]
+	// argument 1 of lower must be scalar, '["%d"]' is [scalar]
+	// argument 1 of lower must be scalar, 'coalesce(null, ["%v"])' is [scalar]
+	// function count takes 1 arguments
+}
+
+func ExampleShortCircuit() {
+	run("[i | i <- [0, 1, 2, 5], i != 0 && 10 / i > 2]")
+	run("[i | i <- [0, 1, 2, 5], i == 0 || 10 / i > 2]")
+	run("false && 1 / 0")
+	run("true || 1 / 0")
+	run("true && 1 / 0")
+	run("{a: 1 && 2, b: 0 || null}")
+
+	// Output:
+	// [1,2]
+	// [0,1,2]
+	// false
+	// true
+	// division by zero in '1 / 0'
+	// {"a":true,"b":false}
+}
+
+func ExampleParallel() {
+	four := Limits{DefaultLimits().Stack, 4}
+	runLimits("[i * 2 | i <~ [1, 2, 3, 4, 5, 6, 7, 8, 9, 10]]", four)
+	runLimits("[{i, j} | i <- [1, 2], j <~ [10, 20, 30], i * 10 != j]", four)
+	runLimits("[{i, j} | i <~ [1, 2, 3], j <~ [1, 2, 3], i < j]", four)
+	runLimits("[[j | j <~ [i, i + 1]] | i <~ [1, 2, 3]]", four)
+	runLimits("[i | i <~ [5, 3, 1, 4, 2], order by i desc, limit 3]", four)
+	runLimits("[i | i <~ [5, 3, 1, 4, 2, 6, 7], i > 1, limit 3]", four)
+	runLimits("[i | i <- [1, 2], j <~ [1, 2, 3, 4, 5], limit 3]", four)
+
+	runLimits("[i * 2 | i <~ [1, 2, 3]]", Limits{DefaultLimits().Stack, 1})
+
+	// Output:
+	// [2,4,6,8,10,12,14,16,18,20]
+	// [{"i":1,"j":20},{"i":1,"j":30},{"i":2,"j":10},{"i":2,"j":30}]
+	// [{"i":1,"j":2},{"i":1,"j":3},{"i":2,"j":3}]
+	// [[1,2],[2,3],[3,4]]
+	// [5,4,3]
+	// [5,3,4]
+	// [1,1,1]
+	// [2,4,6]
+}
+
 func ExampleErrors() {
 	run("a")
 	run("b + a")
@@ -412,6 +780,8 @@ func ExampleErrors() {
 	run(`[i | i <- [1, 2, 3], i <- [1, 2, 3]]`)
 	run(`[i | i <- 3 + 5]`)
 	run(`{3, 3}`)
+	run(`[1][0].z`)
+	run(`[[1]][0][1].z`)
 
 	// Output:
 	// unknown identifier 'a'
@@ -423,6 +793,59 @@ func ExampleErrors() {
 	// 'i' is already declared
 	// '3 + 5' is not a list
 	// duplicate attribute '3' in object literal
+	// '[1][0]' is not an object
+	// '[[1]][0][1]' is not an object
+}
+
+func ExampleSuggestions() {
+	runWithInputs("[p.nmae | p <- people]", "people.csv", "id,name\n1,Alice\n")
+	runWithInputs("[p.id | p <- peopel]", "people.csv", "id,name\n1,Alice\n")
+	run("cont([1, 2])")
+	run("[i | i <- [1, 2], j <- [x]]")
+
+	// Output:
+	// object 'p' does not have field 'nmae' (did you mean 'name'?)
+	// unknown identifier 'peopel' (did you mean 'people'?)
+	// unknown function cont (did you mean 'count'?)
+	// unknown identifier 'x'
+}
+
+func ExampleRuntimeErrors() {
+	run("1 / 0")
+	run("[10 / (i - 1) | i <- [3, 2, 1]]")
+	run("[10 / i | i <~ [1, 2, 0]]")
+	run("let x = 0 in trunc(1 / x)")
+	runWithInputs("[i.x | i <- in]", "in.json", `[{"x": 1}, null]`)
+	runWithInputs("[i.x | i <- in]", "in.json", `[{"x": 1}, 2]`)
+	runWithInputs("[i.x | i <- in]", "in.json", `[{"x": 1}, [2]]`)
+
+	// Output:
+	// division by zero in '1 / 0'
+	// division by zero in '10 / (i - 1)'
+	// division by zero in '10 / i'
+	// division by zero in '1 / x'
+	// [1,null]
+	// cannot get a field of a scalar in 'i.x'
+	// cannot get a field of a list in 'i.x'
+}
+
+func ExampleStack() {
+	terms := make([]string, 500)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("%d", i)
+	}
+	sum := strings.Join(terms, " + ")
+
+	run(sum)
+	runLimits(sum, Limits{100, 1})
+	runLimits("1 + 2 + 3", Limits{2, 1})
+	runLimits("1 + 2", Limits{2, 1})
+
+	// Output:
+	// 124750
+	// stack overflow (more than 100 values)
+	// stack overflow (more than 2 values)
+	// 3
 }
 
 func ExampleJSON() {
@@ -439,11 +862,153 @@ func ExampleJSON() {
 	runWithInputs("[i | i <- in.list, i != 2]", "in.json", json)
 	runWithInputs("in.obj.id", "in.json", json)
 
+	commits := `[
+		{"sha": "a1", "author": {"login": "ostap"}},
+		{"sha": "b2", "author": null, "parents": [{"sha": "a1"}]},
+		{"sha": "c3"}
+	]`
+
+	runWithInputs("[c.sha | c <- in, c.author is null]", "in.json", commits)
+	runWithInputs("[c.author.login | c <- in]", "in.json", commits)
+	runWithInputs("[count(c.parents) | c <- in]", "in.json", commits)
+	runWithInputs("in.obj", "in.json", `{"obj": {"b": 1, "c": 2, "a": 3}}`)
+	runWithInputs("[e | e <- in]", "in.jsonl", "{\"b\": 1}\n{\"c\": 2, \"a\": 3}\n")
+
 	// Output:
 	// 2
 	// "hello world"
 	// [1,3]
 	// 153
+	// ["b2","c3"]
+	// ["ostap",null,null]
+	// [0,1,0]
+	// {"a":3,"b":1,"c":2}
+	// [{"b":1,"a":null,"c":null},{"b":null,"a":3,"c":2}]
+}
+
+func ExampleCSV() {
+	rows := make([]string, 1000)
+	for i := range rows {
+		rows[i] = fmt.Sprintf("%d,%d", i, i*i)
+	}
+	csv := "i,sq\n" + strings.Join(rows, "\n")
+
+	runWithInputs(`[r | r <- t, r.i < 3]`, "t.csv", csv)
+	runWithInputs(`[r.i | r <- t, r.i > 996]`, "t.csv", csv)
+	runWithInputs(`[{i: r.i, l: r["line()"]} | r <- t, r.i == 0 || r.i == 999]`, "t.csv", csv)
+	runWithInputs(`[r["line()"] | r <- t, r.b is null]`, "t.csv", "a,b\n1,\n2,x\n3\n")
+	runWithInputs(`[r | r <- t]`, "t.txt", "a\tb\nx\ty\n")
+	runWithInputs(`count([{r, s} | r <- d, s <- d, r == s])`, "d.csv", "a,b\n1,x\n1,x\n")
+	runWithInputs(`[{a: r.a, b: r.b} == r | r <- d]`, "d.csv", "a,b\n1,x\n")
+	runWithInputs(`[{k, n: count(g)} | r <- d, group r by k = r.a into g]`, "d.csv", "a,b\n1,x\n1,x\n")
+	runWithInputs(`[r["line()"] | r <- d]`, "d.csv", "a,b\n1,\"x\ny\"\n\n2,z\n")
+	runWithInputs(`[{a: r.a, l: r["line()"]} == {a: s.a, l: s["line()"]} | r <- d, s <- d]`, "d.csv", "a\n1\n1\n")
+	runWithInputs(`count([k | r <- d, group r by k = {a: r.a, l: r["line()"]} into g])`, "d.csv", "a\n1\n1\n")
+	runWithInputs(`[{r, l: r["line()"]} | r <- d]`, "d.csv", "a,line()\n1,x\n2,y\n")
+
+	// Output:
+	// [{"i":0,"sq":0},{"i":1,"sq":1},{"i":2,"sq":4}]
+	// [997,998,999]
+	// [{"i":0,"l":2},{"i":999,"l":1001}]
+	// [2,4]
+	// [{"a":"x","b":"y"}]
+	// 4
+	// [true]
+	// [{"k":1,"n":2}]
+	// [2,5]
+	// [true,false,false,true]
+	// 2
+	// [{"r":{"a":1},"l":"x"},{"r":{"a":2},"l":"y"}]
+}
+
+func ExampleJSONL() {
+	jsonl := `{"id": 1, "level": "info"}
+{"id": 2, "level": "error", "msg": "failed"}
+
+{"id": 3, "level": "error"}`
+
+	runWithInputs("[e.id | e <- in, e.level == `error`]", "in.jsonl", jsonl)
+	runWithInputs("[coalesce(e.msg, `-`) | e <- in]", "in.ndjson", jsonl)
+	runWithInputs("count(in)", "in.jsonl", "")
+	runWithInputs("count(in)", "in.jsonl", "{\"id\": 1}\n{\"id\": \n")
+
+	// Output:
+	// [2,3]
+	// ["-","failed","-"]
+	// 0
+	// failed to load in.jsonl: line 2: unexpected end of JSON input
+}
+
+func ExampleFormats() {
+	const people = "[{name: `Ostap`, age: 33, tags: [1, 2]}, {name: `Julius, Jr.`, age: null, tags: [3]}]"
+
+	runFormat(people, "jsonl")
+	runFormat(people, "csv")
+	runFormat(people, "tsv")
+	runFormat(people, "table")
+	runFormat("[i * 2 | i <- [1, 2, 3]]", "csv")
+	runFormat("[{i} | i <- [1, 2], i > 2]", "csv")
+	runFormat("{a: 1, b: `x`}", "table")
+	runFormat("1 + 2", "csv")
+	runFormat("1 + 2", "xml")
+
+	// Output:
+	// {"name":"Ostap","age":33,"tags":[1,2]}
+	// {"name":"Julius, Jr.","age":null,"tags":[3]}
+	// name,age,tags
+	// Ostap,33,"[1,2]"
+	// "Julius, Jr.",,[3]
+	// name	age	tags
+	// Ostap	33	[1,2]
+	// Julius, Jr.		[3]
+	// name         age  tags
+	// ----         ---  ----
+	// Ostap        33   [1,2]
+	// Julius, Jr.       [3]
+	// 2
+	// 4
+	// 6
+	// i
+	// a  b
+	// -  -
+	// 1  x
+	// 3
+	// unknown output format xml (use one of json, jsonl, csv, tsv, table)
+}
+
+func ExampleRepl() {
+	store := NewStore()
+	store.Add("t.csv", strings.NewReader("id,name\n1,a\n"))
+
+	session := `
+		[r.name | r <- t]
+		count(t)
+		:type [{r.id, n: [r.name]} | r <- t]
+		:symbols
+		[r.id | r <- t
+		unknown
+		:load nothing.json
+		:what
+		:quit
+		1 + 1`
+
+	Repl(store, strings.NewReader(session), os.Stdout, "json", DefaultLimits())
+
+	// Output:
+	// > > ["a"]
+	// > 1
+	// > [{r.id: scalar, n: [scalar]}]
+	// > available symbols:
+	//   t (list, 1 elements)
+	// > error (line 1, column 15): syntax error
+	//   [r.id | r <- t
+	//                 ^
+	// > error (line 1, column 1): unknown identifier 'unknown'
+	//   unknown
+	//   ^
+	// > error: open nothing.json: no such file or directory
+	// > unknown command :what (see :help)
+	// >
 }
 
 func ExampleXML() {
@@ -476,9 +1041,117 @@ func ExampleXML() {
 	// [1,2]
 }
 
-func _run(expr string, inputs map[string]io.Reader) {
+// TestOutput checks that the whole result (with the trailing newline) is
+// written to the output of Run and nothing is printed to stdout.
+func TestOutput(t *testing.T) {
+	tests := []struct {
+		expr     string
+		format   string
+		expected string
+	}{
+		{"1 + 1", "json", "2\n"},
+		{"[1, 2]", "json", "[1,2]\n"},
+		{"[1, 2]", "jsonl", "1\n2\n"},
+	}
+
+	for _, test := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := os.Stdout
+		os.Stdout = w
+
+		got := new(bytes.Buffer)
+		err = Run(test.expr, nil, got, test.format)
+
+		os.Stdout = stdout
+		w.Close()
+		printed, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		if err != nil {
+			t.Fatalf("%v: %v", test.expr, err)
+		}
+		if got.String() != test.expected || len(printed) > 0 {
+			t.Errorf("%v: expected %q, got %q (stdout %q)", test.expr, test.expected, got.String(), printed)
+		}
+	}
+}
+
+// TestExitCodes runs the test binary as the command line tool (see
+// TestMainProcess).
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"1 + 1"}, 0, "2\n", ""},
+		{[]string{"-f", "missing.json", "1"}, exitLoad, "", "open missing.json: no such file or directory\n"},
+		{[]string{"1 +"}, exitCompile, "", "error (line 1, column 4): syntax error\n  1 +\n     ^\n"},
+		{[]string{"-errors", "json", "1 +"}, exitCompile, "", `{"line":1,"column":4,"error":"syntax error"}` + "\n"},
+		{[]string{"-errors", "json", "foo + [1].x"}, exitCompile, "", `{"line":1,"column":1,"error":"unknown identifier 'foo'","more":[{"line":1,"column":7,"error":"'[1]' is not an object"}]}` + "\n"},
+		{[]string{"1 / 0"}, exitRuntime, "", "division by zero in '1 / 0'\n"},
+		{[]string{"[10 / (i - 1) | i <- [3, 2, 1]]"}, exitRuntime, "", "division by zero in '10 / (i - 1)'\n"},
+		{[]string{"-errors", "json", "1 / 0"}, exitRuntime, "", `{"line":0,"column":0,"error":"division by zero in '1 / 0'"}` + "\n"},
+		{[]string{"-o", "xls", "1"}, exitUsage, "", "unknown output format xls (use one of json, jsonl, csv, tsv, table)\n"},
+	}
+
+	for _, test := range tests {
+		cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestMainProcess", "--"}, test.args...)...)
+		cmd.Env = append(os.Environ(), "COMP_MAIN=1")
+
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+
+		code := 0
+		if err := cmd.Run(); err != nil {
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				t.Fatalf("%v: %v", test.args, err)
+			}
+			code = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+
+		if code != test.code || stdout.String() != test.stdout || stderr.String() != test.stderr {
+			t.Errorf("%v: expected %d %q %q, got %d %q %q", test.args, test.code, test.stdout, test.stderr,
+				code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+// TestMainProcess is not a real test, it runs main with the arguments after
+// "--" when started by TestExitCodes.
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("COMP_MAIN") != "1" {
+		return
+	}
+
+	for i, arg := range os.Args {
+		if arg == "--" {
+			os.Args = append([]string{"comp"}, os.Args[i+1:]...)
+			break
+		}
+	}
+
+	main()
+	os.Exit(0)
+}
+
+func _run(expr string, inputs map[string]io.Reader, format string) {
+	buf := new(bytes.Buffer)
+	if err := Run(expr, inputs, buf, format); err != nil {
+		fmt.Printf("%v\n", err)
+	} else {
+		fmt.Printf("%v", buf.String())
+	}
+}
+
+func runLimits(expr string, limits Limits) {
 	buf := new(bytes.Buffer)
-	if err := Run(expr, inputs, buf); err != nil {
+	if err := Eval(NewStore(), expr, buf, "json", limits); err != nil {
 		fmt.Printf("%v\n", err)
 	} else {
 		fmt.Printf("%v", buf.String())
@@ -489,9 +1162,13 @@ func runWithInputs(expr, file, data string) {
 	inputs := make(map[string]io.Reader)
 	inputs[file] = strings.NewReader(data)
 
-	_run(expr, inputs)
+	_run(expr, inputs, "json")
+}
+
+func runFormat(expr, format string) {
+	_run(expr, nil, format)
 }
 
 func run(expr string) {
-	_run(expr, nil)
+	_run(expr, nil, "json")
 }
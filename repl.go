@@ -0,0 +1,111 @@
+// Copyright (c) 2013 Ostap Cherkashin. You can use this source code
+// under the terms of the MIT License found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const replHelp = `enter an expression or one of the commands:
+  :symbols        list the loaded files
+  :type <expr>    show the type of an expression
+  :load <file>    load a file
+  :help           show this help
+  :quit           exit (or Ctrl-D)
+`
+
+// Repl reads expressions and commands line by line and writes the results
+// (or errors) until the end of the input or the :quit command. The values of
+// the store are loaded once and shared by all of the expressions.
+func Repl(store Store, in io.Reader, out io.Writer, format string, limits Limits) {
+	store.Collect()
+
+	lines := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(out, "> ")
+		if !lines.Scan() {
+			fmt.Fprintf(out, "\n")
+			return
+		}
+
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, ":") {
+			if err := Eval(store, line, out, format, limits); err != nil {
+				report(out, line, err)
+			}
+			continue
+		}
+
+		cmd, arg := line, ""
+		if sp := strings.Index(line, " "); sp > 0 {
+			cmd, arg = line[:sp], strings.TrimSpace(line[sp+1:])
+		}
+
+		switch cmd {
+		case ":symbols":
+			store.PrintSymbols(out)
+		case ":type":
+			if _, t, err := Compile(arg, store.Decls()); err != nil {
+				report(out, arg, err)
+			} else {
+				fmt.Fprintf(out, "%v\n", describe(t))
+			}
+		case ":load":
+			if err := load(store, arg); err != nil {
+				report(out, "", err)
+			}
+		case ":help":
+			fmt.Fprintf(out, replHelp)
+		case ":quit", ":q":
+			return
+		default:
+			fmt.Fprintf(out, "unknown command %v (see :help)\n", cmd)
+		}
+	}
+}
+
+func load(store Store, fileName string) error {
+	r, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := store.Add(fileName, r); err != nil {
+		return err
+	}
+
+	store.Collect()
+	return nil
+}
+
+// report writes out an error. All of the parse errors are written with their
+// positions pointing at the expression.
+func report(out io.Writer, expr string, err error) {
+	pe, ok := err.(*ParseError)
+	if !ok {
+		fmt.Fprintf(out, "error: %v\n", err)
+		return
+	}
+
+	for _, e := range append([]*ParseError{pe}, pe.More...) {
+		if e.Line < 1 {
+			fmt.Fprintf(out, "error: %v\n", e.Message)
+			continue
+		}
+
+		fmt.Fprintf(out, "error (line %d, column %d): %v\n", e.Line, e.Column, e.Message)
+		if snippet := e.Snippet(expr); snippet != "" {
+			fmt.Fprintf(out, "%v\n", snippet)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Ostap Cherkashin. You can use this source code
+// under the terms of the MIT License found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const maxQuery = 64 * 1024 /* bytes */
+
+var contentTypes = map[string]string{
+	"json":  "application/json",
+	"jsonl": "application/x-ndjson",
+	"csv":   "text/csv",
+	"tsv":   "text/tab-separated-values",
+	"table": "text/plain",
+}
+
+// Server evaluates the expressions posted to it against the values of the
+// store, which are loaded once and shared by all of the requests. A query
+// is stopped after the timeout and fails if its result exceeds the limit
+// (in bytes). The programs run within the limits of their resources.
+type Server struct {
+	store   Store
+	timeout time.Duration
+	limit   int
+	limits  Limits
+}
+
+// limitWriter fails the writes beyond the limit and halts the program
+// producing them.
+type limitWriter struct {
+	w     io.Writer
+	limit int
+	n     int
+	halt  *int32
+}
+
+type reply struct {
+	status int
+	body   []byte
+	err    error
+}
+
+func NewServer(store Store, timeout time.Duration, limit int, limits Limits) *Server {
+	store.Collect()
+	return &Server{store, timeout, limit, limits}
+}
+
+// Serve listens on the address (e.g. ":8080") for queries.
+func Serve(addr string, srv *Server) error {
+	hs := &http.Server{
+		Addr:         addr,
+		Handler:      srv,
+		ReadTimeout:  srv.timeout,
+		WriteTimeout: 2 * srv.timeout,
+	}
+
+	log.Printf("serving queries on %v", addr)
+	return hs.ListenAndServe()
+}
+
+// ServeHTTP evaluates the expression from the body of a POST request. The
+// output format is json unless specified with ?format=<name>. Failures are
+// reported as a JSON object {"line": ..., "column": ..., "error": ...}.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		fail(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST to send a query"))
+		return
+	}
+
+	expr, err := ioutil.ReadAll(io.LimitReader(r.Body, maxQuery+1))
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(expr) > maxQuery {
+		fail(w, http.StatusRequestEntityTooLarge, fmt.Errorf("query exceeds %d bytes", maxQuery))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	halt := new(int32)
+	done := make(chan reply, 1)
+	go func() {
+		done <- srv.eval(string(expr), format, halt)
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			fail(w, res.status, res.err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypes[format])
+		w.Write(res.body)
+	case <-time.After(srv.timeout):
+		atomic.StoreInt32(halt, 1) /* the program stops at its next iteration in the background */
+		fail(w, http.StatusServiceUnavailable, fmt.Errorf("query exceeds %v", srv.timeout))
+	}
+}
+
+func (srv *Server) eval(expr, format string, halt *int32) (res reply) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("query %q failed: %v", expr, r)
+			res = reply{http.StatusInternalServerError, nil, fmt.Errorf("%v", r)}
+		}
+	}()
+
+	prg, rt, err := Compile(expr, srv.store.Decls())
+	if err != nil {
+		return reply{http.StatusBadRequest, nil, err}
+	}
+	prg.halt = halt
+	prg.limits = srv.limits
+
+	buf := new(bytes.Buffer)
+	lw := &limitWriter{buf, srv.limit, 0, halt}
+	if err := Exec(prg, rt, lw, format); err != nil {
+		if lw.n > lw.limit {
+			return reply{http.StatusRequestEntityTooLarge, nil, err}
+		}
+
+		return reply{http.StatusBadRequest, nil, err}
+	}
+
+	return reply{http.StatusOK, buf.Bytes(), nil}
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	l.n += len(p)
+	if l.n > l.limit {
+		atomic.StoreInt32(l.halt, 1)
+		return 0, fmt.Errorf("result exceeds %d bytes", l.limit)
+	}
+
+	return l.w.Write(p)
+}
+
+func fail(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(asParseError(err))
+}
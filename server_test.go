@@ -0,0 +1,70 @@
+// Copyright (c) 2013 Ostap Cherkashin. You can use this source code
+// under the terms of the MIT License found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func query(t *testing.T, srv *Server, method, url, expr string) (int, string) {
+	req, e := http.NewRequest(method, url, strings.NewReader(expr))
+	if e != nil {
+		t.Fatalf("%v: %v", expr, e)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	return rec.Code, rec.Body.String()
+}
+
+func TestServer(t *testing.T) {
+	store, e := Load(map[string]io.Reader{"nums.csv": strings.NewReader("n\n1\n2\n3\n")})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	srv := NewServer(store, time.Second, 64, DefaultLimits())
+	tests := []struct {
+		method string
+		url    string
+		expr   string
+		status int
+		body   string
+	}{
+		{"POST", "/", "count(nums)", 200, "3\n"},
+		{"POST", "/", "[n.n | n <- nums, n.n > 1]", 200, "[2,3]\n"},
+		{"POST", "/?format=csv", "[{n.n} | n <- nums]", 200, "n.n\n1\n2\n3\n"},
+		{"POST", "/", "1 +", 400, `{"line":1,"column":4,"error":"syntax error"}` + "\n"},
+		{"POST", "/?format=xls", "1", 400, `{"line":0,"column":0,"error":"unknown output format xls (use one of json, jsonl, csv, tsv, table)"}` + "\n"},
+		{"POST", "/", `[i | i <- nums, j <- nums, k <- nums]`, 413, `{"line":0,"column":0,"error":"result exceeds 64 bytes"}` + "\n"},
+		{"GET", "/", "1", 405, `{"line":0,"column":0,"error":"use POST to send a query"}` + "\n"},
+	}
+
+	for _, test := range tests {
+		status, body := query(t, srv, test.method, test.url, test.expr)
+		if status != test.status || body != test.body {
+			t.Errorf("%v: expected %d %q, got %d %q", test.expr, test.status, test.body, status, body)
+		}
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	srv := NewServer(NewStore(), 10*time.Millisecond, 64, DefaultLimits())
+
+	loop := "count([1 | a <- [1, 2, 3, 4, 5, 6, 7, 8, 9, 10], b <- [a, 2, 3, 4, 5, 6, 7, 8, 9, 10], " +
+		"c <- [b, 2, 3, 4, 5, 6, 7, 8, 9, 10], d <- [c, 2, 3, 4, 5, 6, 7, 8, 9, 10], " +
+		"e <- [d, 2, 3, 4, 5, 6, 7, 8, 9, 10], f <- [e, 2, 3, 4, 5, 6, 7, 8, 9, 10], " +
+		"g <- [f, 2, 3, 4, 5, 6, 7, 8, 9, 10], h <- [g, 2, 3, 4, 5, 6, 7, 8, 9, 10]])"
+
+	status, body := query(t, srv, "POST", "/", loop)
+	if status != 503 || !strings.Contains(body, "query exceeds 10ms") {
+		t.Errorf("expected a timeout, got %d %q", status, body)
+	}
+}
@@ -15,18 +15,21 @@ import (
 	"path"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-type Body chan Value
-
 type Store struct {
 	types  map[string]Type
 	values map[string]Value
 }
 
+func NewStore() Store {
+	return Store{make(map[string]Type), make(map[string]Value)}
+}
+
 type Stats struct {
 	Total int
 	Found int
@@ -34,15 +37,58 @@ type Stats struct {
 
 type line struct {
 	lineNo int
+	pos    int /* the line of the file where the record starts */
 	rec    []string
 }
 
+// row is a converted line of a CSV or text file.
+type row struct {
+	lineNo int
+	obj    Object
+}
+
+// record is a decoded line of a JSON Lines file (or the error decoding it).
+type record struct {
+	lineNo int
+	t      Type
+	v      interface{}
+	err    error
+}
+
 type LineReader interface {
 	Read() (rec []string, err error)
+	// Line returns the line of the file (counting from 1) where the last
+	// record read starts.
+	Line() int
+}
+
+// RawLineReader reads whole lines (including the last one without a
+// trailing new line).
+type RawLineReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (r *RawLineReader) Read() ([]string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.line++
+
+	return []string{strings.TrimRight(line, "\r\n")}, nil
+}
+
+func (r *RawLineReader) Line() int {
+	return r.line
 }
 
 type TabLineReader struct {
 	reader *bufio.Reader
+	line   int
 }
 
 func (r *TabLineReader) Read() ([]string, error) {
@@ -51,10 +97,40 @@ func (r *TabLineReader) Read() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	r.line++
 
 	return strings.Split(line[:len(line)-1], "\t"), nil
 }
 
+func (r *TabLineReader) Line() int {
+	return r.line
+}
+
+// CSVLineReader reads the records of a CSV file, which may span several
+// lines (quoted fields) or skip the blank ones.
+type CSVLineReader struct {
+	*csv.Reader
+}
+
+func (r CSVLineReader) Line() int {
+	line, _ := r.FieldPos(0)
+	return line
+}
+
+type byLineNo []record
+
+func (b byLineNo) Len() int {
+	return len(b)
+}
+
+func (b byLineNo) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byLineNo) Less(i, j int) bool {
+	return b[i].lineNo < b[j].lineNo
+}
+
 func (s Store) IsDef(name string) bool {
 	return s.types[name] != nil
 }
@@ -76,6 +152,8 @@ func (s Store) Add(fileName string, r io.Reader) error {
 	switch path.Ext(fileName) {
 	case ".json":
 		t, v, err = readJSON(r)
+	case ".jsonl", ".ndjson":
+		t, v, err = readJSONL(rawReader(r), fileName)
 	case ".xml":
 		t, v, err = readXML(r)
 	case ".csv":
@@ -83,7 +161,7 @@ func (s Store) Add(fileName string, r io.Reader) error {
 	case ".txt":
 		t, v, err = readText(tsvReader(r), fileName)
 	default:
-		err = fmt.Errorf("unknown content type %v (use one of json, xml, csv, txt)", path.Ext(fileName))
+		err = fmt.Errorf("unknown content type %v (use one of json, jsonl, ndjson, xml, csv, txt)", path.Ext(fileName))
 	}
 
 	if err != nil {
@@ -96,17 +174,33 @@ func (s Store) Add(fileName string, r io.Reader) error {
 	return nil
 }
 
-func (s Store) PrintSymbols() {
-	log.Printf("available symbols:")
-	for n, v := range s.values {
+func (s Store) PrintSymbols(w io.Writer) {
+	names := make([]string, 0, len(s.values))
+	for n := range s.values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "available symbols:\n")
+	for _, n := range names {
 		info := fmt.Sprintf("  %v (%v", n, s.types[n].Name())
-		switch value := v.(type) {
+		switch value := s.values[n].(type) {
 		case List:
 			info = fmt.Sprintf("%v, %v elements", info, len(value))
 		case Object:
 			info = fmt.Sprintf("%v, %v fields", info, len(value))
 		}
-		log.Printf("%v)", info)
+		fmt.Fprintf(w, "%v)\n", info)
+	}
+}
+
+// Collect turns the streamed values (e.g. rows of CSV files) into lists, so
+// they can be queried repeatedly.
+func (s Store) Collect() {
+	for n, v := range s.values {
+		if body, isBody := v.(*Body); isBody {
+			s.values[n] = body.List()
+		}
 	}
 }
 
@@ -123,6 +217,11 @@ func (s Store) Decls() *Decls {
 	decls.AddFunc(FuncUpper())
 	decls.AddFunc(FuncFuzzy())
 	decls.AddFunc(FuncReplace())
+	decls.AddFunc(FuncCount())
+	decls.AddFunc(FuncSum())
+	decls.AddFunc(FuncAvg())
+	decls.AddFunc(FuncMin())
+	decls.AddFunc(FuncMax())
 
 	return decls
 }
@@ -224,95 +323,80 @@ func readXML(r io.Reader) (Type, Value, error) {
 	return traverse(nil, value)
 }
 
+// traverse infers the type of decoded JSON (or XML) data v and converts it
+// into a value. Objects of the same list are merged into a single object type
+// with the fields missing in some of them set to null, values of different
+// kinds make a union type.
 func traverse(h Type, v interface{}) (Type, Value, error) {
+	t := widen(h, infer(v))
+	return t, convert(t, v), nil
+}
+
+// infer returns the type of a decoded JSON value. The fields of objects are
+// sorted by their names as the decoded maps have no order.
+func infer(v interface{}) Type {
 	switch v.(type) {
 	case nil:
-		return ScalarType(0), Bool(false), nil
+		return NullType(0)
 	case map[string]interface{}:
-		elems := v.(map[string]interface{})
-		val := make(Object, len(elems))
-
-		var head ObjectType
-		switch h.(type) {
-		case ObjectType:
-			head = h.(ObjectType)
-			if len(head) != len(elems) { /* very strict */
-				return nil, nil, fmt.Errorf("invalid object type, expected %v got %v", head, elems)
-			}
-		case nil:
-			head = make(ObjectType, len(elems))
-		default:
-			return nil, nil, fmt.Errorf("expected object, got %v (%v)", h.Name(), v)
+		fields := v.(map[string]interface{})
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
 		}
+		sort.Strings(names) /* the same order in every run */
 
-		idx := 0
-		for name, value := range elems {
-			t, v, e := traverse(head.Type(name), value)
-			if e != nil {
-				return nil, nil, e
-			}
-
-			if h == nil {
-				head[idx].Name = name
-				head[idx].Type = t
-			}
-			i := head.Pos(name)
-			if i < 0 {
-				return nil, nil, fmt.Errorf("cannot find field %v in %v (%v)", name, head, v)
-			}
-			val[i] = v
-
-			idx++
+		head := make(ObjectType, 0, len(names))
+		for _, name := range names {
+			head = append(head, ObjectType{{name, infer(fields[name])}}...)
 		}
 
-		return head, val, nil
+		return head
 	case []interface{}:
-		elems := v.([]interface{})
-		val := make(List, len(elems))
-
-		var head ListType
-		switch h.(type) {
-		case ListType:
-			head = h.(ListType)
-		case nil:
-			head = ListType{}
-		default:
-			return nil, nil, fmt.Errorf("expected list, got %v (%v)", h.Name(), v)
+		head := ListType{}
+		for _, value := range v.([]interface{}) {
+			head.Elem = widen(head.Elem, infer(value))
 		}
 
-		for idx, value := range elems {
-			t, v, e := traverse(head.Elem, value)
-			if e != nil {
-				return nil, nil, e
+		return head
+	}
+
+	return ScalarType(0)
+}
+
+func convert(t Type, v interface{}) Value {
+	switch v.(type) {
+	case nil:
+		return Nil
+	case map[string]interface{}:
+		elems := v.(map[string]interface{})
+		head := narrow(t, "object").(ObjectType)
+		val := make(Object, len(head))
+		for i, f := range head {
+			if value, ok := elems[f.Name]; ok {
+				val[i] = convert(f.Type, value)
+			} else {
+				val[i] = Nil
 			}
+		}
 
-			head.Elem = t
-			val[idx] = v
+		return val
+	case []interface{}:
+		elems := v.([]interface{})
+		head := narrow(t, "list").(ListType)
+		val := make(List, len(elems))
+		for i, value := range elems {
+			val[i] = convert(head.Elem, value)
 		}
 
-		return head, val, nil
+		return val
 	case bool:
-		switch h.(type) {
-		case nil, ScalarType:
-			return ScalarType(0), Bool(v.(bool)), nil
-		default:
-			return nil, nil, fmt.Errorf("expected bool, got %v (%v)", h.Name(), v)
-		}
+		return Bool(v.(bool))
 	case float64:
-		switch h.(type) {
-		case nil, ScalarType:
-			return ScalarType(0), Number(v.(float64)), nil
-		default:
-			return nil, nil, fmt.Errorf("expected number, got %v (%v)", h.Name(), v)
-		}
-	default:
-		switch h.(type) {
-		case nil, ScalarType:
-			return ScalarType(0), String(v.(string)), nil
-		default:
-			return nil, nil, fmt.Errorf("expected string, got %v (%v)", h.Name(), v)
-		}
+		return Number(v.(float64))
 	}
+
+	return String(v.(string))
 }
 
 func readJSON(r io.Reader) (Type, Value, error) {
@@ -334,7 +418,7 @@ func csvReader(in io.Reader) LineReader {
 	r.TrailingComma = true
 	r.FieldsPerRecord = -1
 
-	return r
+	return CSVLineReader{r}
 }
 
 func tsvReader(in io.Reader) LineReader {
@@ -347,20 +431,39 @@ func readText(r LineReader, fileName string) (Type, Value, error) {
 		return nil, nil, err
 	}
 
-	head := make(ObjectType, len(rec))
+	head := make(ObjectType, len(rec)+1)
 	for i, f := range rec {
 		head[i].Name = strings.Trim(f, " \r\n")
 		head[i].Type = ScalarType(0)
 	}
+	head[len(rec)].Name = lineField
+	head[len(rec)].Type = ScalarType(0)
+	if head[:len(rec)].Has(lineField) { /* the file has its own line numbers */
+		head = head[:len(rec)]
+	}
 
 	t := ListType{Elem: head}
-	return t, readBody(t, fileName, r), nil
+	return t, readBody(t, len(rec), fileName, r), nil
+}
+
+func rawReader(in io.Reader) LineReader {
+	return &RawLineReader{reader: bufio.NewReader(in)}
 }
 
-func readBody(t ListType, fileName string, r LineReader) List {
+// readLines feeds the lines of a file into a channel (closed at the end)
+// logging the progress.
+func readLines(fileName string, r LineReader, stop chan bool) chan line {
 	lines := make(chan line, 1024)
 	go func() {
+		ticker := time.NewTicker(3 * time.Second)
+	read:
 		for lineNo := 0; ; lineNo++ {
+			select {
+			case <-ticker.C:
+				log.Printf("loading %v (%d lines)", fileName, lineNo)
+			default:
+			}
+
 			rec, err := r.Read()
 			if err == io.EOF {
 				break
@@ -368,65 +471,158 @@ func readBody(t ListType, fileName string, r LineReader) List {
 				log.Printf("failed to parse %v, %v", fileName, err)
 				break
 			}
-			lines <- line{lineNo, rec}
+			select {
+			case lines <- line{lineNo, r.Line(), rec}:
+			case <-stop:
+				break read
+			}
 		}
+		ticker.Stop()
 		close(lines)
 	}()
 
-	tuples := make(Body, 1024)
+	return lines
+}
+
+// readJSONL reads a JSON value per line (decoded in parallel) into a list
+// keeping the order of lines. It fails on the first malformed line.
+func readJSONL(r LineReader, fileName string) (Type, Value, error) {
+	lines := readLines(fileName, r, nil)
+	records := make(chan record, 1024)
 	ctl := make(chan int)
 
-	ot := t.Elem.(ObjectType)
 	for i := 0; i < runtime.NumCPU(); i++ {
-		go processLine(i, ot, lines, tuples, ctl)
+		go processJSON(lines, records, ctl)
 	}
 	go func() {
 		for i := 0; i < runtime.NumCPU(); i++ {
 			<-ctl
 		}
-		close(tuples)
+		close(records)
 	}()
 
-	ticker := time.NewTicker(3 * time.Second)
-	list := make(List, 0)
-
-	count := 0
-	stop := false
-	for !stop {
-		select {
-		case <-ticker.C:
-			log.Printf("loading %v (%d tuples)", fileName, count)
-		case t, ok := <-tuples:
-			if !ok {
-				stop = true
-				break
+	var data []record
+	var bad *record
+	for r := range records {
+		if r.err != nil {
+			if bad == nil || r.lineNo < bad.lineNo {
+				bad = &record{r.lineNo, nil, nil, r.err}
 			}
+			continue
+		}
 
-			list = append(list, t)
-			count++
+		data = append(data, r)
+	}
+
+	if bad != nil {
+		return nil, nil, fmt.Errorf("line %d: %v", bad.lineNo+1, bad.err)
+	}
+
+	sort.Sort(byLineNo(data))
+
+	head := ListType{} /* widened in the order of the lines (see infer) */
+	for _, r := range data {
+		head.Elem = widen(head.Elem, r.t)
+	}
+
+	list := make(List, len(data))
+	for i, r := range data {
+		list[i] = convert(head.Elem, r.v)
+	}
+
+	return head, list, nil
+}
+
+func processJSON(in chan line, out chan record, ctl chan int) {
+	for l := range in {
+		if strings.TrimSpace(l.rec[0]) == "" {
+			continue
 		}
+
+		var v interface{}
+		if err := json.Unmarshal([]byte(l.rec[0]), &v); err != nil {
+			out <- record{l.lineNo, nil, nil, err}
+			continue
+		}
+
+		out <- record{l.lineNo, infer(v), v, nil}
+	}
+
+	ctl <- 1
+}
+
+// readBody converts the lines (of cols fields) in parallel and streams the
+// rows in the order of the file.
+func readBody(t ListType, cols int, fileName string, r LineReader) *Body {
+	stop := make(chan bool)
+	lines := readLines(fileName, r, stop)
+	rows := make(chan row, 1024)
+	tuples := make(chan Value, 1024)
+	ctl := make(chan int)
+
+	ot := t.Elem.(ObjectType)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go processLine(i, ot, cols, lines, rows, ctl, stop)
 	}
-	ticker.Stop()
+	go func() {
+		for i := 0; i < runtime.NumCPU(); i++ {
+			<-ctl
+		}
+		close(rows)
+	}()
+	go reorder(rows, tuples, stop)
+
+	return NewBody(tuples, stop)
+}
 
-	return list
+// reorder writes the rows to the body by their line numbers (as the workers
+// may convert them out of order) and closes the body. It gives up on the
+// remaining rows once stop is closed.
+func reorder(in chan row, out chan Value, stop chan bool) {
+	defer close(out)
+
+	pending := make(map[int]Object)
+	next := 0
+	for r := range in {
+		pending[r.lineNo] = r.obj
+		for obj, ok := pending[next]; ok; obj, ok = pending[next] {
+			delete(pending, next)
+			select {
+			case out <- obj:
+			case <-stop:
+				return
+			}
+			next++
+		}
+	}
 }
 
-func processLine(id int, ot ObjectType, in chan line, out Body, ctl chan int) {
+// processLine converts the fields of a line into an object with the line
+// number (counting the header as line 1) in the last hidden field, unless
+// the file has its own line() column (then its values are hidden instead).
+func processLine(id int, ot ObjectType, cols int, in chan line, out chan row, ctl chan int, stop chan bool) {
 	count := 0
+	lineCol := ot.Pos(lineField)
 	for l := range in {
+		lineNo := l.pos
 		fields := l.rec
-		if len(fields) > len(ot) {
-			log.Printf("line %d: truncating object (-%d fields)", l.lineNo, len(fields)-len(ot))
-			fields = fields[:len(ot)]
-		} else if len(fields) < len(ot) {
-			log.Printf("line %d: missing fields, appending blank strings", l.lineNo)
-			for len(fields) < len(ot) {
+		if len(fields) > cols {
+			log.Printf("line %d: truncating object (-%d fields)", lineNo, len(fields)-cols)
+			fields = fields[:cols]
+		} else if len(fields) < cols {
+			log.Printf("line %d: missing fields, appending nulls", lineNo)
+			for len(fields) < cols {
 				fields = append(fields, "")
 			}
 		}
 
 		obj := make(Object, len(ot))
 		for i, s := range fields {
+			if s == "" {
+				obj[i] = Nil
+				continue
+			}
+
 			num, err := strconv.ParseFloat(s, 64)
 			if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
 				obj[i] = String(s)
@@ -436,7 +632,18 @@ func processLine(id int, ot ObjectType, in chan line, out Body, ctl chan int) {
 			}
 		}
 
-		out <- obj
+		if lineCol == cols {
+			obj[cols] = Line{Number(lineNo)}
+		} else {
+			obj[lineCol] = Line{obj[lineCol]}
+		}
+
+		select {
+		case out <- row{l.lineNo, obj}:
+		case <-stop:
+			ctl <- 1
+			return
+		}
 	}
 
 	ctl <- 1
@@ -6,6 +6,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -17,6 +18,10 @@ func _readXML(xmlBlob string) (Type, Value, error) {
 	return readXML(bufio.NewReader(bytes.NewReader([]byte(xmlBlob))))
 }
 
+func _readJSONL(jsonlBlob string) (Type, Value, error) {
+	return readJSONL(rawReader(bytes.NewReader([]byte(jsonlBlob))), "test.jsonl")
+}
+
 func ok(t *testing.T, blobType, blob string) {
 	var rt Type
 	var rv Value
@@ -26,6 +31,8 @@ func ok(t *testing.T, blobType, blob string) {
 		rt, rv, err = _readXML(blob)
 	} else if blobType == "json" {
 		rt, rv, err = _readJSON(blob)
+	} else if blobType == "jsonl" {
+		rt, rv, err = _readJSONL(blob)
 	}
 	if err != nil || rt == nil || rv == nil {
 		t.Log("error:", err)
@@ -42,6 +49,8 @@ func err(t *testing.T, blobType, blob string) {
 		rt, rv, err = _readXML(blob)
 	} else if blobType == "json" {
 		rt, rv, err = _readJSON(blob)
+	} else if blobType == "jsonl" {
+		rt, rv, err = _readJSONL(blob)
 	}
 	if err == nil || rt != nil || rv != nil {
 		t.Log("error:", err)
@@ -70,25 +79,39 @@ func TestJSONBasic(t *testing.T) {
         [1,"hello"]
     `)
 
-	err(t, "json", `
+	ok(t, "json", `
         [{},"hello"]
     `)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Name": "Platypus"}, {"Name": []}
     ]`)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Name": "Platypus"}, {"Name": {}}
     ]`)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Name": "Platypus"}, {"Id": "Quoll"}
     ]`)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Name": "Platypus"}, {"name": "Quoll"}
     ]`)
+
+	ok(t, "json", `[
+        {"Name": "Platypus", "Id": 1}, {"Id": 2}, {"Name": null}
+    ]`)
+
+	ok(t, "json", `[
+        {"Name": "Platypus"}, {"Id": "Quoll"}, {"Name": {}}
+    ]`)
+
+	ok(t, "json", `[1, "a", {"x": 1}, [1], null]`)
+
+	err(t, "json", `[1, 2`)
+
+	err(t, "json", `{"Name": "Platypus",}`)
 }
 
 func TestJSONNested(t *testing.T) {
@@ -110,20 +133,57 @@ func TestJSONNested(t *testing.T) {
         {"Order": [{"Id": "hello"}]}
     ]`)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Order": [{"Id": 1}, {"Id": 2}, {"Id": 3}]},
         {"Order": [1, 2, 3]}
     ]`)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Order": [{"Id": 1}, {"Id": 2}, {"Id": 3}]},
         {"Order": [[]]}
     ]`)
 
-	err(t, "json", `[
+	ok(t, "json", `[
         {"Order": [{"Id": 1}, {"Id": 2}, {"Id": 3}]},
         {"Order": [{}]}
     ]`)
+
+	ok(t, "json", `[
+        {"Order": [{"Id": 1}]},
+        {"Order": [{"Name": "Quoll"}]},
+        {"Total": 3}
+    ]`)
+
+	ok(t, "json", `[
+        {"Order": [{"Id": 1}]},
+        {"Order": [{"Id": [2]}]}
+    ]`)
+}
+
+func TestJSONL(t *testing.T) {
+	ok(t, "jsonl", ``)
+
+	ok(t, "jsonl", `{"Name": "Platypus"}`)
+
+	ok(t, "jsonl", `{"Name": "Platypus"}
+{"Name": "Quoll", "Id": 2}
+
+{"Id": null}
+`)
+
+	ok(t, "jsonl", `1
+"hello"
+[1, 2]
+{"Name": "Platypus"}`)
+
+	err(t, "jsonl", `{"Name": "Platypus"}
+{"Name": broken
+{"Name": "Quoll"}`)
+
+	_, _, e := _readJSONL("1\n2\n{\n3\n[\n")
+	if e == nil || !strings.HasPrefix(e.Error(), "line 3: ") {
+		t.Errorf("expected an error on line 3, got %v", e)
+	}
 }
 
 func TestXML(t *testing.T) {
@@ -203,7 +263,7 @@ func TestXML(t *testing.T) {
         <item>
     `)
 
-	err(t, "xml", `
+	ok(t, "xml", `
         <?xml version="1.0" encoding="UTF-8"?>
         <!-- comment -->
         <item a="attribute">
@@ -3,6 +3,11 @@
 
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Generic type
 type Type interface {
 	Name() string
@@ -15,7 +20,16 @@ func (s ScalarType) Name() string {
 	return "scalar"
 }
 
-// List type specifies the type of its elements.
+// Null type is the type of missing values, it is compatible with any other
+// type.
+type NullType int
+
+func (n NullType) Name() string {
+	return "null"
+}
+
+// List type specifies the type of its elements. A nil element type stands
+// for a list of any (or unknown) elements, e.g. an empty JSON array.
 type ListType struct {
 	Elem Type
 }
@@ -69,6 +83,410 @@ func (o ObjectType) Type(field string) Type {
 	return nil
 }
 
+// Fields returns the names of the fields.
+func (o ObjectType) Fields() []string {
+	res := make([]string, len(o))
+	for i, e := range o {
+		res[i] = e.Name
+	}
+
+	return res
+}
+
+// Union type holds the alternative types of values of different kinds (at
+// most one scalar, list and object type), the actual kind of a value is only
+// known at runtime.
+type UnionType []Type
+
+func (u UnionType) Name() string {
+	return "union"
+}
+
+// align makes objects and lists of objects of a union share the same object
+// type (e.g. XML elements which occur once or repeatedly).
+func (u UnionType) align() UnionType {
+	o, l := -1, -1
+	for i, t := range u {
+		switch t.(type) {
+		case ObjectType:
+			o = i
+		case ListType:
+			l = i
+		}
+	}
+
+	if o < 0 || l < 0 {
+		return u
+	}
+
+	elem := u[l].(ListType).Elem
+	if _, isObject := elem.(ObjectType); elem != nil && !isObject {
+		return u
+	}
+
+	u[o] = widen(u[o], elem)
+	u[l] = ListType{u[o]}
+
+	return u
+}
+
+// narrow returns the alternative of the given kind ("scalar", "list" or
+// "object") if t is a union (or t itself otherwise).
+func narrow(t Type, kind string) Type {
+	if u, isUnion := t.(UnionType); isUnion {
+		for _, a := range u {
+			if a.Name() == kind {
+				return a
+			}
+		}
+	}
+
+	return t
+}
+
+// widen returns a type which holds values of both types a and b: objects
+// are merged (fields missing in one of them are optional) and types of
+// different kinds become a union.
+func widen(a, b Type) Type {
+	if _, isNull := a.(NullType); isNull || a == nil {
+		return b
+	} else if _, isNull := b.(NullType); isNull || b == nil {
+		return a
+	}
+
+	if u, isUnion := b.(UnionType); isUnion {
+		for _, t := range u {
+			a = widen(a, t)
+		}
+
+		return a
+	}
+
+	if u, isUnion := a.(UnionType); isUnion {
+		res := append(UnionType(nil), u...)
+		for i, t := range res {
+			if t.Name() == b.Name() {
+				res[i] = widen(t, b)
+				return res.align()
+			}
+		}
+
+		return append(res, b).align()
+	}
+
+	switch at := a.(type) {
+	case ScalarType:
+		if _, isScalar := b.(ScalarType); isScalar {
+			return at
+		}
+	case ListType:
+		if bt, isList := b.(ListType); isList {
+			return ListType{widen(at.Elem, bt.Elem)}
+		}
+	case ObjectType:
+		if bt, isObject := b.(ObjectType); isObject {
+			res := append(ObjectType(nil), at...)
+			for _, f := range bt {
+				pos := res.Pos(f.Name)
+				if pos < 0 {
+					res = append(res, f)
+				} else {
+					res[pos].Type = widen(res[pos].Type, f.Type)
+				}
+			}
+
+			return res
+		}
+	}
+
+	return UnionType{a, b}.align()
+}
+
+// unify returns the type common to both a and b (nil if there is none). A
+// union is common with the unions (or types) of the same or fewer kinds.
+func unify(a, b Type) Type {
+	if _, isNull := a.(NullType); isNull {
+		return b
+	} else if _, isNull := b.(NullType); isNull {
+		return a
+	}
+
+	ua, aUnion := a.(UnionType)
+	ub, bUnion := b.(UnionType)
+	if aUnion || bUnion {
+		if !aUnion {
+			ua = UnionType{a}
+		} else if !bUnion {
+			ub = UnionType{b}
+		}
+		if len(ua) < len(ub) {
+			ua, ub = ub, ua
+		}
+
+		res := append(UnionType(nil), ua...)
+		for _, t := range ub {
+			pos := -1
+			for i, r := range res {
+				if r.Name() == t.Name() {
+					pos = i
+				}
+			}
+
+			if pos < 0 {
+				return nil
+			} else if res[pos] = unify(res[pos], t); res[pos] == nil {
+				return nil
+			}
+		}
+
+		return res
+	}
+
+	switch at := a.(type) {
+	case ScalarType:
+		if _, isScalar := b.(ScalarType); isScalar {
+			return at
+		}
+	case ListType:
+		bt, isList := b.(ListType)
+		if !isList {
+			return nil
+		} else if at.Elem == nil {
+			return bt
+		} else if bt.Elem == nil {
+			return at
+		}
+
+		if elem := unify(at.Elem, bt.Elem); elem != nil {
+			return ListType{elem}
+		}
+	case ObjectType:
+		bt, isObject := b.(ObjectType)
+		if !isObject || len(at) != len(bt) {
+			return nil
+		}
+
+		res := make(ObjectType, len(at))
+		for i, f := range at {
+			pos := bt.Pos(f.Name)
+			if pos < 0 {
+				return nil
+			}
+
+			res[i].Name = f.Name
+			res[i].Type = unify(f.Type, bt[pos].Type)
+			if res[i].Type == nil {
+				return nil
+			}
+		}
+
+		return res
+	}
+
+	return nil
+}
+
+// union returns the type holding values of both a and b (nil if there is
+// none). Unlike widen it keeps the layout of the values: types of different
+// kinds become a union, but objects must have the same fields (matched by
+// name, the values of b are laid out as in a, see relayout).
+func union(a, b Type) Type {
+	if _, isNull := a.(NullType); isNull {
+		return b
+	} else if _, isNull := b.(NullType); isNull {
+		return a
+	}
+
+	if u, isUnion := b.(UnionType); isUnion {
+		for _, t := range u {
+			if a = union(a, t); a == nil {
+				return nil
+			}
+		}
+
+		return a
+	}
+
+	if u, isUnion := a.(UnionType); isUnion {
+		res := append(UnionType(nil), u...)
+		for i, t := range res {
+			if t.Name() == b.Name() {
+				if res[i] = union(t, b); res[i] == nil {
+					return nil
+				}
+
+				return res
+			}
+		}
+
+		return append(res, b)
+	}
+
+	if a.Name() != b.Name() {
+		return UnionType{a, b}
+	}
+
+	switch at := a.(type) {
+	case ListType:
+		bt := b.(ListType)
+		if at.Elem == nil {
+			return bt
+		} else if bt.Elem == nil {
+			return at
+		}
+
+		if elem := union(at.Elem, bt.Elem); elem != nil {
+			return ListType{elem}
+		}
+
+		return nil
+	case ObjectType:
+		bt := b.(ObjectType)
+		if len(at) != len(bt) {
+			return nil
+		}
+
+		res := make(ObjectType, len(at))
+		for i, f := range at {
+			pos := bt.Pos(f.Name)
+			if pos < 0 {
+				return nil
+			}
+
+			res[i].Name = f.Name
+			res[i].Type = union(f.Type, bt[pos].Type)
+			if res[i].Type == nil {
+				return nil
+			}
+		}
+
+		return res
+	}
+
+	return a
+}
+
+// sameLayout checks if the values of type t are laid out as the ones of the
+// type want, i.e. the fields of their objects are in the same order.
+func sameLayout(t, want Type) bool {
+	switch tt := t.(type) {
+	case UnionType:
+		for _, a := range tt {
+			if !sameLayout(a, want) {
+				return false
+			}
+		}
+	case ObjectType:
+		wt, isObject := narrow(want, "object").(ObjectType)
+		if !isObject {
+			return true
+		} else if len(tt) != len(wt) {
+			return false
+		}
+
+		for i, f := range tt {
+			if f.Name != wt[i].Name || !sameLayout(f.Type, wt[i].Type) {
+				return false
+			}
+		}
+	case ListType:
+		if wt, isList := narrow(want, "list").(ListType); isList {
+			return sameLayout(tt.Elem, wt.Elem)
+		}
+	}
+
+	return true
+}
+
+// relayout converts a value of type t into the layout of the type want
+// (see unify and union), matching the fields of objects by name.
+func relayout(v Value, t, want Type) Value {
+	if isNull(v) {
+		return v
+	}
+
+	switch wt := narrow(want, kindOf(v)).(type) {
+	case ObjectType:
+		obj, ot := v.(Object), narrow(t, "object").(ObjectType)
+		res := make(Object, len(wt))
+		for i, f := range wt {
+			if pos := ot.Pos(f.Name); pos < 0 {
+				res[i] = Nil
+			} else {
+				res[i] = relayout(obj[pos], ot[pos].Type, f.Type)
+			}
+		}
+
+		return res
+	case ListType:
+		lt := narrow(t, "list").(ListType)
+		list := v.List()
+		res := make(List, len(list))
+		for i, e := range list {
+			res[i] = relayout(e, lt.Elem, wt.Elem)
+		}
+
+		return res
+	}
+
+	return v
+}
+
+// fits checks if the values of type t can be used where the type want is
+// expected. Nulls fit anywhere and unions fit if one of the alternatives does.
+func fits(t, want Type) bool {
+	if _, isNull := t.(NullType); isNull || t == nil || want == nil {
+		return true
+	}
+
+	if wt, isList := want.(ListType); isList {
+		lt, isList := narrow(t, "list").(ListType)
+		return isList && (lt.Elem == nil || fits(lt.Elem, wt.Elem))
+	}
+
+	return narrow(t, want.Name()).Name() == want.Name()
+}
+
+// describe writes out the structure of a type, e.g. [{id: scalar}].
+func describe(t Type) string {
+	switch tt := t.(type) {
+	case ListType:
+		if tt.Elem == nil {
+			return "[]"
+		}
+
+		return fmt.Sprintf("[%v]", describe(tt.Elem))
+	case ObjectType:
+		fields := make([]string, 0, len(tt))
+		for _, f := range tt {
+			if !hidden(f.Name) {
+				fields = append(fields, fmt.Sprintf("%v: %v", f.Name, describe(f.Type)))
+			}
+		}
+
+		return fmt.Sprintf("{%v}", strings.Join(fields, ", "))
+	case UnionType:
+		alts := make([]string, len(tt))
+		for i, a := range tt {
+			alts[i] = describe(a)
+		}
+
+		return strings.Join(alts, " | ")
+	case nil:
+		return "unknown"
+	}
+
+	return t.Name()
+}
+
+// lineField is the hidden field of CSV and text rows holding their line
+// number. Hidden fields are not written to the output nor compared.
+const lineField = "line()"
+
+func hidden(name string) bool {
+	return name == lineField
+}
+
 // TypeOfExpr(eid) references the type of an expression.
 type TypeOfExpr int64
 
@@ -106,3 +524,19 @@ type TypeOfIdent string
 func (toi TypeOfIdent) Name() string {
 	return "typeOfIdent"
 }
+
+// TypeOfCommon{eid1, eid2, ...} references the type common to all of the
+// expressions (e.g. branches of a conditional expression).
+type TypeOfCommon []int64
+
+func (toc TypeOfCommon) Name() string {
+	return "typeOfCommon"
+}
+
+// TypeOfUnion{eid1, eid2, ...} references the union of the types of all of
+// the expressions (e.g. elements of a list literal).
+type TypeOfUnion []int64
+
+func (tou TypeOfUnion) Name() string {
+	return "typeOfUnion"
+}
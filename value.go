@@ -4,11 +4,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"strconv"
+	"sync"
 )
 
 type Bool bool
@@ -16,9 +18,32 @@ type Number float64
 type String string
 type List []Value
 type Object []Value
+type Null struct{}
+
+// Line is the number of a line in a file held by the hidden field of a row
+// (see lineField). It is left out when rows are compared or hashed. Only the
+// rows hold Line values, the value of the field itself is a plain one (see
+// opGet).
+type Line struct {
+	Value
+}
+
+// Body is a list of values streamed from a loader (e.g. rows of a CSV file).
+// The values are either iterated over once (Next) or collected into a list
+// shared by all of the queries (List).
+type Body struct {
+	rows   chan Value
+	stop   chan bool
+	mu     sync.Mutex
+	list   List
+	done   bool /* the values are collected into the list */
+	used   bool /* the values are consumed by Next */
+	closed bool
+}
 
 var True Value = Bool(true)
 var False Value = Bool(false)
+var Nil Value = Null{}
 
 type Value interface {
 	Bool() Bool
@@ -41,6 +66,173 @@ func marshal(w io.Writer, v interface{}) error {
 	return err
 }
 
+// parseNum converts numeric strings to numbers (NaN and infinities are
+// not considered to be numeric).
+func parseNum(s string) (float64, bool) {
+	num, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(num) || math.IsInf(num, 0) {
+		return 0, false
+	}
+
+	return num, true
+}
+
+// kinds of values as named by their types (see opIs)
+var kinds = []string{"null", "scalar", "list", "object"}
+
+func kindOf(v Value) string {
+	switch v.(type) {
+	case Null:
+		return "null"
+	case List:
+		return "list"
+	case Object:
+		return "object"
+	}
+
+	return "scalar"
+}
+
+// isNull tells whether the value is missing (JSON null, blank CSV field).
+func isNull(v Value) bool {
+	_, null := v.(Null)
+	return null
+}
+
+// equals compares two values, null is only equal to null.
+func equals(l, r Value) Bool {
+	if isNull(l) || isNull(r) {
+		return Bool(isNull(l) && isNull(r))
+	}
+
+	return l.Equals(r)
+}
+
+// hashKey returns the same key for values which are equal to each other
+// (numbers, booleans and numeric strings are all keyed by their numeric
+// value). It is used to place values into hash buckets.
+func hashKey(v Value) string {
+	switch t := v.(type) {
+	case Bool:
+		return "n:" + string(t.Number().String())
+	case Number:
+		return "n:" + string(t.String())
+	case Line:
+		return hashKey(t.Value)
+	case String:
+		if num, ok := parseNum(string(t)); ok {
+			return "n:" + string(Number(num).String())
+		}
+
+		return "s:" + string(t)
+	case List:
+		return "l:" + hashKeys(t)
+	case Object:
+		return "o:" + hashKeys(visible(t))
+	case Null:
+		return "0:"
+	}
+
+	return fmt.Sprintf("?:%v", v)
+}
+
+// kinds of hash keys (see keyKind)
+const (
+	keyNum    = 1 << iota // numbers
+	keyNumStr             // numeric strings
+	keyStr                // other strings
+	keyBool               // booleans
+	keyOther              // lists, objects
+)
+
+// keyKind tells which kind of hash key the value gets (0 for null).
+func keyKind(v Value) int {
+	switch t := v.(type) {
+	case Bool:
+		return keyBool
+	case Number:
+		return keyNum
+	case Line:
+		return keyKind(t.Value)
+	case String:
+		if _, ok := parseNum(string(t)); ok {
+			return keyNumStr
+		}
+
+		return keyStr
+	case Null:
+		return 0
+	}
+
+	return keyOther
+}
+
+// keyed checks if the values of the kinds (a mask of keyKind) that are equal
+// to each other always get the same hash keys. It is not the case e.g. for
+// 0 == "abc" or true == 2 as the operands of == are converted to the type of
+// the left one.
+func keyed(kinds int) bool {
+	return kinds&^(keyNum|keyNumStr) == 0 ||
+		kinds&^(keyNumStr|keyStr) == 0 ||
+		kinds == keyBool
+}
+
+func hashKeys(vals []Value) string {
+	buf := new(bytes.Buffer)
+	for _, v := range vals {
+		k := hashKey(v)
+		fmt.Fprintf(buf, "%d:%v", len(k), k)
+	}
+
+	return buf.String()
+}
+
+// rank places a value into one of the ordered categories (numbers, strings,
+// the rest and nulls) and returns its numeric or string value for
+// comparisons.
+func rank(v Value) (int, float64, string) {
+	switch t := v.(type) {
+	case Bool:
+		return 0, float64(t.Number()), ""
+	case Number:
+		if !math.IsNaN(float64(t)) {
+			return 0, float64(t), ""
+		}
+	case Line:
+		return rank(t.Value)
+	case String:
+		if num, ok := parseNum(string(t)); ok {
+			return 0, num, ""
+		}
+
+		return 1, 0, string(t)
+	case Null:
+		return 3, 0, ""
+	}
+
+	return 2, 0, ""
+}
+
+// compare orders values: numbers (including booleans and numeric strings)
+// come first and are compared numerically, other strings follow in the
+// lexicographic order, the rest (lists, objects, NaN) is considered equal
+// and nulls come last.
+func compare(l, r Value) int {
+	lr, ln, ls := rank(l)
+	rr, rn, rs := rank(r)
+
+	switch {
+	case lr != rr:
+		return lr - rr
+	case ln < rn, ls < rs:
+		return -1
+	case ln > rn, ls > rs:
+		return 1
+	}
+
+	return 0
+}
+
 func (b Bool) Bool() Bool {
 	return b
 }
@@ -171,7 +363,7 @@ func (l List) Quote(w io.Writer, t Type) error {
 		return err
 	}
 
-	lt, isList := t.(ListType)
+	lt, isList := narrow(t, "list").(ListType)
 	if !isList {
 		return fmt.Errorf("internal error: %v is not a list", t.Name())
 	}
@@ -200,7 +392,7 @@ func (l List) Equals(v Value) Bool {
 	}
 
 	for i := 0; i < len(l); i++ {
-		if !l[i].Equals(r[i]) {
+		if !equals(l[i], r[i]) {
 			return false
 		}
 	}
@@ -221,7 +413,7 @@ func (o Object) String() String {
 }
 
 func (o Object) List() List {
-	return nil
+	return List{o}
 }
 
 func (o Object) Object() Object {
@@ -234,18 +426,22 @@ func (o Object) Quote(w io.Writer, t Type) error {
 		return err
 	}
 
-	ot, isObject := t.(ObjectType)
+	ot, isObject := narrow(t, "object").(ObjectType)
 	if !isObject {
 		return fmt.Errorf("internal error: %v is not an object", t.Name())
 	}
 
+	sep := ""
 	for i, v := range o {
-		if i != 0 {
-			_, err = io.WriteString(w, ",")
-			if err != nil {
-				return err
-			}
+		if hidden(ot[i].Name) {
+			continue
+		}
+
+		_, err = io.WriteString(w, sep)
+		if err != nil {
+			return err
 		}
+		sep = ","
 
 		_, err = fmt.Fprintf(w, `%v:`, strconv.Quote(ot[i].Name))
 		if err != nil {
@@ -263,16 +459,129 @@ func (o Object) Quote(w io.Writer, t Type) error {
 
 func (o Object) Equals(v Value) Bool {
 	// FIXME: algorithm assumes the same field ordering for both objects
-	r := v.Object()
+	o, r := visible(o), visible(v.Object())
 	if len(o) != len(r) {
 		return false
 	}
 
 	for i := 0; i < len(o); i++ {
-		if !bool(o[i].Equals(r[i])) {
+		if !bool(equals(o[i], r[i])) {
 			return false
 		}
 	}
 
 	return true
 }
+
+// visible returns the fields of an object without the hidden line number.
+func visible(o Object) Object {
+	for i, v := range o {
+		if _, isLine := v.(Line); isLine {
+			return append(o[:i:i], o[i+1:]...)
+		}
+	}
+
+	return o
+}
+
+func (n Null) Bool() Bool {
+	return false
+}
+
+func (n Null) Number() Number {
+	return Number(math.NaN())
+}
+
+func (n Null) String() String {
+	return ""
+}
+
+func (n Null) List() List {
+	return nil
+}
+
+func (n Null) Object() Object {
+	return nil
+}
+
+func (n Null) Quote(w io.Writer, t Type) error {
+	_, err := io.WriteString(w, "null")
+	return err
+}
+
+func (n Null) Equals(v Value) Bool {
+	return Bool(isNull(v))
+}
+
+// NewBody streams the values sent to rows (until it is closed) from a
+// loader which gives up once stop is closed.
+func NewBody(rows chan Value, stop chan bool) *Body {
+	return &Body{rows: rows, stop: stop}
+}
+
+// Next returns the next value of the stream (false at the end).
+func (b *Body) Next() (Value, bool) {
+	b.mu.Lock()
+	b.used = true
+	b.mu.Unlock()
+
+	v, ok := <-b.rows
+	return v, ok
+}
+
+// Close stops the loader of a stream iterated over by Next (which may have
+// been left before the end, e.g. by limit). The collected values are kept.
+func (b *Body) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used && !b.closed {
+		close(b.stop)
+		b.closed = true
+	}
+}
+
+func (b *Body) Bool() Bool {
+	return b.List().Bool()
+}
+
+func (b *Body) Number() Number {
+	return Number(math.NaN())
+}
+
+func (b *Body) String() String {
+	return ""
+}
+
+// List collects the values of the stream (once, all of the callers get the
+// same list).
+func (b *Body) List() List {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.done {
+		if b.used {
+			raise("", "the stream has already been iterated over")
+		}
+
+		b.list = make(List, 0)
+		for v := range b.rows {
+			b.list = append(b.list, v)
+		}
+		b.done = true
+	}
+
+	return b.list
+}
+
+func (b *Body) Object() Object {
+	return nil
+}
+
+func (b *Body) Quote(w io.Writer, t Type) error {
+	return b.List().Quote(w, t)
+}
+
+func (b *Body) Equals(v Value) Bool {
+	return b.List().Equals(v)
+}